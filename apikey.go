@@ -0,0 +1,294 @@
+package zero
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKey describes server-to-server credentials, only hash of the secret is stored
+type APIKey struct {
+	ID          string
+	Name        string
+	Hash        string // sha256 of the secret part in hex
+	Scopes      []string
+	Expires     time.Time // zero value means key never expires
+	RateLimit   int64     // requests allowed per RateWindow, 0 means unlimited
+	RateWindow  time.Duration
+	ReferenceID int64 // will be set as req.ReferenceID for authenticated requests
+}
+
+// HasScope checks if key is allowed to use scope, "*" scope allows everything
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired return true if key is not valid anymore
+func (k *APIKey) IsExpired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// APIKeys is a registry of api keys with HMAC request signing support
+// Key issued to the client looks like "id.secret", signing secret is derived from master secret and key id
+type APIKeys struct {
+	master       []byte
+	keys         map[string]*APIKey
+	keysRWMux    sync.RWMutex
+	Lookup       func(id string) *APIKey // optional loader for keys which are not registered in memory
+	SignWindow   time.Duration           // max difference between signature timestamp and server time, 5 minutes if not set
+	rates        map[string]*apiKeyRate
+	signatures   map[string]int64 // seen signatures to prevent replays
+	limitsMux    sync.Mutex
+	lastCleaning int64
+}
+
+type apiKeyRate struct {
+	window  int64
+	count   int64
+	expires int64 // unix nano time when window is over
+}
+
+// APIKeysNew creates registry, master secret is used to derive signing secrets of keys
+func APIKeysNew(master []byte) *APIKeys {
+	return &APIKeys{
+		master:     master,
+		keys:       map[string]*APIKey{},
+		SignWindow: time.Minute * 5,
+		rates:      map[string]*apiKeyRate{},
+		signatures: map[string]int64{},
+	}
+}
+
+// APIKeyHash return hash of the key secret as it is stored in registry
+func APIKeyHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates new key, returns full key which should be passed to the client only once
+func (a *APIKeys) Issue(key APIKey) (string, *APIKey, error) {
+	if key.ID == "" {
+		id, err := RandomHex(8)
+		if err != nil {
+			return "", nil, err
+		}
+		key.ID = id
+	}
+	if strings.Contains(key.ID, ".") {
+		return "", nil, errors.New("api key id should not contain dots")
+	}
+	secret, err := RandomHex(32)
+	if err != nil {
+		return "", nil, err
+	}
+	key.Hash = APIKeyHash(secret)
+	a.Add(&key)
+	return key.ID + "." + secret, &key, nil
+}
+
+// Add registers already existing key, for example loaded from database
+func (a *APIKeys) Add(key *APIKey) {
+	a.keysRWMux.Lock()
+	a.keys[key.ID] = key
+	a.keysRWMux.Unlock()
+}
+
+// Revoke removes key from registry
+func (a *APIKeys) Revoke(id string) {
+	a.keysRWMux.Lock()
+	delete(a.keys, id)
+	a.keysRWMux.Unlock()
+}
+
+// Get return key by id
+func (a *APIKeys) Get(id string) *APIKey {
+	a.keysRWMux.RLock()
+	key, ok := a.keys[id]
+	a.keysRWMux.RUnlock()
+	if !ok && a.Lookup != nil {
+		return a.Lookup(id)
+	}
+	return key
+}
+
+// SigningSecret return secret which client uses to sign requests with key id
+func (a *APIKeys) SigningSecret(id string) string {
+	mac := hmac.New(sha256.New, a.master)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks full key "id.secret" and return registered key
+func (a *APIKeys) Verify(fullKey string) (*APIKey, error) {
+	id, secret := SplitDoubleString(fullKey, ".")
+	if id == "" || secret == "" {
+		return nil, errors.New("api key has invalid format")
+	}
+	// unknown and wrong keys get the same error, so key ids could not be enumerated
+	key := a.Get(id)
+	if key == nil {
+		return nil, errors.New("api key is invalid")
+	}
+	if subtle.ConstantTimeCompare([]byte(APIKeyHash(secret)), []byte(key.Hash)) != 1 {
+		return nil, errors.New("api key is invalid")
+	}
+	return key, nil
+}
+
+// allow counts request for the key and return false if key rate limit exceeded
+func (a *APIKeys) allow(key *APIKey) bool {
+	if key.RateLimit <= 0 {
+		return true
+	}
+	window := key.RateWindow
+	if window <= 0 {
+		window = time.Minute
+	}
+	now := time.Now().UnixNano()
+	current := now / int64(window)
+	a.limitsMux.Lock()
+	defer a.limitsMux.Unlock()
+	a.clean(now / int64(time.Second))
+	rate, ok := a.rates[key.ID]
+	if !ok || rate.window != current {
+		rate = &apiKeyRate{window: current, expires: (current + 1) * int64(window)}
+		a.rates[key.ID] = rate
+	}
+	rate.count++
+	return rate.count <= key.RateLimit
+}
+
+// authorize performs checks common for both auth schemes
+func (a *APIKeys) authorize(req *Request, key *APIKey) {
+	if key.IsExpired() {
+		req.ErrAuth("api_key_expired", "api key is expired")
+	}
+	if !a.allow(key) {
+		req.ErrFlood("api_key_flood", "api key rate limit exceeded")
+	}
+	req.APIKey = key
+	req.ReferenceID = key.ReferenceID
+}
+
+// Middleware authenticates request by key passed in X-API-Key or Authorization: Bearer header
+func (a *APIKeys) Middleware(req *Request, next func()) {
+	fullKey := req.GetHeader("X-API-Key")
+	if fullKey == "" {
+		auth := req.GetHeader("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			fullKey = strings.TrimSpace(auth[7:])
+		}
+	}
+	if fullKey == "" {
+		req.ErrAuth("api_key", "api key is required")
+	}
+	key, err := a.Verify(fullKey)
+	if err != nil {
+		req.ErrAuth("api_key", err)
+	}
+	a.authorize(req, key)
+	next()
+}
+
+// SignatureString return canonical string which is signed by client:
+// method, path with query, unix timestamp and sha256 of body in hex separated by new lines
+func SignatureString(method, path string, timestamp int64, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.ToUpper(method) + "\n" + path + "\n" + strconv.FormatInt(timestamp, 10) + "\n" + hex.EncodeToString(bodyHash[:])
+}
+
+// Sign return hex signature of request, clients can use it to prepare X-Signature header
+func Sign(signingSecret, method, path string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte(SignatureString(method, path, timestamp, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureMiddleware authenticates request signed with HMAC
+// using X-Key-ID, X-Timestamp and X-Signature headers
+func (a *APIKeys) SignatureMiddleware(req *Request, next func()) {
+	id := req.GetHeader("X-Key-ID")
+	signature := strings.ToLower(req.GetHeader("X-Signature"))
+	timestamp := I64(req.GetHeader("X-Timestamp"))
+	if id == "" || signature == "" || timestamp == 0 {
+		req.ErrAuth("signature", "X-Key-ID, X-Timestamp and X-Signature headers are required")
+	}
+	window := int64(a.SignWindow / time.Second)
+	if window <= 0 {
+		window = 300
+	}
+	diff := Now() - timestamp
+	if diff > window || diff < -window {
+		req.ErrAuth("signature_expired", "request timestamp is out of allowed window")
+	}
+	key := a.Get(id)
+	if key == nil {
+		req.ErrAuth("signature", "signature is invalid") // same as wrong signature, so key ids could not be enumerated
+	}
+	expected := Sign(a.SigningSecret(id), req.Method(), string(req.Ctx.RequestURI()), timestamp, req.GetBody())
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		req.ErrAuth("signature", "signature is invalid")
+	}
+	if !a.remember(signature, timestamp+window) {
+		req.ErrAuth("signature_replay", "request was already processed")
+	}
+	a.authorize(req, key)
+	next()
+}
+
+// remember stores signature till expiration and return false if it was already seen
+func (a *APIKeys) remember(signature string, expires int64) bool {
+	a.limitsMux.Lock()
+	defer a.limitsMux.Unlock()
+	a.clean(Now())
+	if _, ok := a.signatures[signature]; ok {
+		return false
+	}
+	a.signatures[signature] = expires
+	return true
+}
+
+// clean removes expired signatures and finished rate windows once a minute, it is called under limitsMux
+func (a *APIKeys) clean(now int64) {
+	if now-a.lastCleaning <= 60 {
+		return
+	}
+	for k, v := range a.signatures {
+		if v < now {
+			delete(a.signatures, k)
+		}
+	}
+	nowNano := now * int64(time.Second)
+	for id, rate := range a.rates {
+		if rate.expires < nowNano {
+			delete(a.rates, id)
+		}
+	}
+	a.lastCleaning = now
+}
+
+// RequireScope creates middleware which allows only keys with all passed scopes
+func (a *APIKeys) RequireScope(scopes ...string) Middleware {
+	return func(req *Request, next func()) {
+		if req.APIKey == nil {
+			req.ErrAuth("api_key", "api key is required")
+		}
+		for _, scope := range scopes {
+			if !req.APIKey.HasScope(scope) {
+				req.ErrForbidden("api_key_scope", "api key has no scope "+scope)
+			}
+		}
+		next()
+	}
+}
@@ -0,0 +1,434 @@
+package zero
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/valyala/fasthttp"
+)
+
+// CacheEntry is a stored response
+type CacheEntry struct {
+	Status     int      `json:"status"`
+	Headers    []KV     `json:"headers"`
+	Body       []byte   `json:"body"`
+	Tags       []string `json:"tags"`
+	Expires    int64    `json:"expires"`     // unixnano till entry is fresh
+	StaleUntil int64    `json:"stale_until"` // unixnano till entry could be served while revalidating
+}
+
+// CacheBackend stores cached responses
+type CacheBackend interface {
+	Get(key string) (*CacheEntry, error)
+	Set(key string, entry *CacheEntry, ttl time.Duration) error
+	// InvalidateTags removes all entries marked with any of tags
+	InvalidateTags(tags ...string) error
+}
+
+// Cache is a middleware caching responses of GET requests
+type Cache struct {
+	Backend      CacheBackend
+	TTL          time.Duration // time the response is fresh
+	Stale        time.Duration // time after TTL the response is served while it is revalidated in background
+	Params       []string      // query params which are part of the key, other params are ignored
+	VaryLanguage bool          // separate entries for every Environment language
+	VaryPlatform bool          // separate entries for every Environment platform
+	Tags         func(req *Request) []string
+	calls        map[string]*cacheCall
+	callsMux     sync.Mutex
+}
+
+// cacheCall is an in progress computation of the entry, other requests wait for it
+type cacheCall struct {
+	done  chan struct{}
+	entry *CacheEntry
+}
+
+// cacheSkipHeaders are generated for every response or belong to the client which made the request
+var cacheSkipHeaders = append([]string{
+	"Set-Cookie", "X-Cache", "Idempotent-Replayed",
+	"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After",
+	"traceparent", "tracestate", "traceresponse", "Server-Timing", "X-Request-ID",
+}, idempotencySkipHeaders...)
+
+func cacheSkipHeader(name string) bool {
+	for _, skip := range cacheSkipHeaders {
+		if strings.EqualFold(name, skip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheNew creates cache middleware
+func CacheNew(backend CacheBackend, ttl time.Duration) *Cache {
+	return &Cache{
+		Backend: backend,
+		TTL:     ttl,
+		calls:   map[string]*cacheCall{},
+	}
+}
+
+// CacheTags marks response of the request with tags which can be used to invalidate it
+func (req *Request) CacheTags(tags ...string) {
+	req.cacheTags = append(req.cacheTags, tags...)
+}
+
+// Invalidate removes all cached responses marked with any of tags
+func (c *Cache) Invalidate(tags ...string) error {
+	return c.Backend.InvalidateTags(tags...)
+}
+
+// Key return cache key of the request
+func (c *Cache) Key(req *Request) string {
+	key := req.Method() + " " + req.Path + "?"
+	params := append([]string{}, c.Params...)
+	sort.Strings(params)
+	args := req.Ctx.QueryArgs()
+	for _, param := range params {
+		key += param + "=" + string(args.Peek(param)) + "&"
+	}
+	if c.VaryLanguage || c.VaryPlatform {
+		env := req.Env()
+		if c.VaryLanguage {
+			key += "|" + env.Language
+		}
+		if c.VaryPlatform {
+			key += "|" + env.PlatformString()
+		}
+	}
+	if req.supportGZip {
+		key += "|gz"
+	}
+	return key
+}
+
+// cachePrivate return true if response could depend on the client, such requests are not cached,
+// otherwise replay would skip route authorization and leak responses to other clients
+func cachePrivate(req *Request) bool {
+	if req.Route != nil && req.Route.IsProtected() {
+		return true
+	}
+	if req.ReferenceID != 0 || req.APIKey != nil {
+		return true
+	}
+	header := &req.Ctx.Request.Header
+	return len(header.Peek("Authorization")) > 0 || len(header.Peek("X-API-Key")) > 0 || len(header.Peek("Cookie")) > 0
+}
+
+// Middleware implements Middleware, protected routes and requests with credentials are not cached
+func (c *Cache) Middleware(req *Request, next func()) {
+	method := req.Method()
+	if req.revalidate || (method != "GET" && method != "HEAD") || cachePrivate(req) {
+		next()
+		return
+	}
+	key := c.Key(req)
+	entry, err := c.Backend.Get(key)
+	if err != nil {
+		Err("[CACHE] get failed", err)
+	}
+	now := time.Now().UnixNano()
+	if entry != nil && now < entry.Expires {
+		c.replay(req, entry, "HIT")
+		return
+	}
+	if entry != nil && now < entry.StaleUntil {
+		c.revalidate(req, key)
+		c.replay(req, entry, "STALE")
+		return
+	}
+
+	call, leader := c.call(key)
+	if !leader {
+		// somebody is already computing this entry
+		<-call.done
+		if call.entry != nil {
+			c.replay(req, call.entry, "HIT")
+			return
+		}
+		next()
+		return
+	}
+	defer c.finish(key, call)
+	req.SetHeader("X-Cache", "MISS")
+	next()
+	call.entry = c.store(req, key)
+}
+
+// call return in progress computation of the key, leader is true if caller should compute it
+func (c *Cache) call(key string) (*cacheCall, bool) {
+	c.callsMux.Lock()
+	defer c.callsMux.Unlock()
+	if c.calls == nil {
+		c.calls = map[string]*cacheCall{}
+	}
+	if call, ok := c.calls[key]; ok {
+		return call, false
+	}
+	call := &cacheCall{done: make(chan struct{})}
+	c.calls[key] = call
+	return call, true
+}
+
+// finish wakes up requests waiting for computation
+func (c *Cache) finish(key string, call *cacheCall) {
+	c.callsMux.Lock()
+	delete(c.calls, key)
+	c.callsMux.Unlock()
+	close(call.done)
+}
+
+// store saves successful response, responses setting cookies or authenticated by later middlewares are never cached
+func (c *Cache) store(req *Request, key string) *CacheEntry {
+	resp := &req.Ctx.Response
+	if cachePrivate(req) || resp.StatusCode() != 200 || resp.IsBodyStream() || len(resp.Header.Peek("Set-Cookie")) > 0 {
+		return nil
+	}
+	now := time.Now()
+	entry := CacheEntry{
+		Status:     resp.StatusCode(),
+		Body:       append([]byte{}, resp.Body()...),
+		Tags:       req.cacheTags,
+		Expires:    now.Add(c.TTL).UnixNano(),
+		StaleUntil: now.Add(c.TTL + c.Stale).UnixNano(),
+	}
+	if c.Tags != nil {
+		entry.Tags = append(entry.Tags, c.Tags(req)...)
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		if !cacheSkipHeader(string(k)) {
+			entry.Headers = append(entry.Headers, KV{Key: string(k), Value: string(v)})
+		}
+	})
+	err := c.Backend.Set(key, &entry, c.TTL+c.Stale)
+	if err != nil {
+		Err("[CACHE] set failed", err)
+	}
+	return &entry
+}
+
+// revalidate runs copy of the request in background through OnRequest and the same middlewares as the client request,
+// only one refresh per key is running, requests waiting for the key get refreshed entry
+func (c *Cache) revalidate(req *Request, key string) {
+	if req.Route == nil || req.Route.Handle == nil {
+		return
+	}
+	call, leader := c.call(key)
+	if !leader {
+		return
+	}
+	request := fasthttp.AcquireRequest()
+	req.Ctx.Request.CopyTo(request)
+	remote := &net.TCPAddr{IP: req.Ctx.RemoteIP()}
+	refresh := Request{
+		Path:        req.Path,
+		PathParams:  req.PathParams,
+		Route:       req.Route,
+		Group:       req.Group,
+		http:        req.http,
+		supportGZip: req.supportGZip,
+		revalidate:  true,
+	}
+	go func() {
+		defer fasthttp.ReleaseRequest(request)
+		defer c.finish(key, call)
+		defer func() {
+			if r := recover(); r != nil && fmt.Sprintf("%v", r) != "skip" {
+				Err("[CACHE] revalidate failed", r)
+			}
+		}()
+		ctx := fasthttp.RequestCtx{}
+		ctx.Init(request, remote, nil)
+		refresh.Ctx = &ctx
+		if refresh.http.OnRequest != nil {
+			refresh.http.OnRequest(&refresh)
+		}
+		refresh.http.handle(&refresh, refresh.Route.Handle)
+		call.entry = c.store(&refresh, key)
+	}()
+}
+
+func (c *Cache) replay(req *Request, entry *CacheEntry, state string) {
+	resp := &req.Ctx.Response
+	resp.SetStatusCode(entry.Status)
+	for _, header := range entry.Headers {
+		if strings.EqualFold(header.Key, "Content-Type") {
+			resp.Header.SetContentType(header.Value)
+			continue
+		}
+		resp.Header.Add(header.Key, header.Value)
+	}
+	resp.Header.Set("X-Cache", state)
+	resp.SetBody(entry.Body)
+}
+
+// CacheLRU is an in-process cache backend with limited number of entries
+type CacheLRU struct {
+	max   int
+	items map[string]*list.Element
+	order *list.List
+	tags  map[string]map[string]bool
+	mux   sync.Mutex
+}
+
+type cacheLRUItem struct {
+	key     string
+	entry   *CacheEntry
+	expires time.Time
+}
+
+// CacheLRUNew creates LRU backend for max entries
+func CacheLRUNew(max int) *CacheLRU {
+	return &CacheLRU{
+		max:   max,
+		items: map[string]*list.Element{},
+		order: list.New(),
+		tags:  map[string]map[string]bool{},
+	}
+}
+
+// Get implements CacheBackend
+func (l *CacheLRU) Get(key string) (*CacheEntry, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	el, ok := l.items[key]
+	if !ok {
+		return nil, nil
+	}
+	item := el.Value.(*cacheLRUItem)
+	if time.Now().After(item.expires) {
+		l.remove(el)
+		return nil, nil
+	}
+	l.order.MoveToFront(el)
+	return item.entry, nil
+}
+
+// Set implements CacheBackend
+func (l *CacheLRU) Set(key string, entry *CacheEntry, ttl time.Duration) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if el, ok := l.items[key]; ok {
+		l.remove(el)
+	}
+	el := l.order.PushFront(&cacheLRUItem{
+		key:     key,
+		entry:   entry,
+		expires: time.Now().Add(ttl),
+	})
+	l.items[key] = el
+	for _, tag := range entry.Tags {
+		if l.tags[tag] == nil {
+			l.tags[tag] = map[string]bool{}
+		}
+		l.tags[tag][key] = true
+	}
+	for l.max > 0 && l.order.Len() > l.max {
+		l.remove(l.order.Back())
+	}
+	return nil
+}
+
+// InvalidateTags implements CacheBackend
+func (l *CacheLRU) InvalidateTags(tags ...string) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for _, tag := range tags {
+		for key := range l.tags[tag] {
+			if el, ok := l.items[key]; ok {
+				l.remove(el)
+			}
+		}
+		delete(l.tags, tag)
+	}
+	return nil
+}
+
+// remove should be called under lock
+func (l *CacheLRU) remove(el *list.Element) {
+	item := el.Value.(*cacheLRUItem)
+	l.order.Remove(el)
+	delete(l.items, item.key)
+	for _, tag := range item.entry.Tags {
+		delete(l.tags[tag], item.key)
+		if len(l.tags[tag]) == 0 {
+			delete(l.tags, tag)
+		}
+	}
+}
+
+// CacheRedis is a cache backend shared between nodes
+type CacheRedis struct {
+	redis  *redis.Client
+	prefix string
+}
+
+// CacheRedisNew creates redis backend
+func CacheRedisNew(client *redis.Client) *CacheRedis {
+	return &CacheRedis{
+		redis:  client,
+		prefix: "cache.",
+	}
+}
+
+// Get implements CacheBackend
+func (r *CacheRedis) Get(key string) (*CacheEntry, error) {
+	data, err := r.redis.Get(r.prefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := CacheEntry{}
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Set implements CacheBackend
+func (r *CacheRedis) Set(key string, entry *CacheEntry, ttl time.Duration) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := r.redis.TxPipeline()
+	pipe.Set(r.prefix+key, data, ttl)
+	for _, tag := range entry.Tags {
+		tagKey := r.prefix + "tag." + tag
+		pipe.SAdd(tagKey, key)
+		pipe.Expire(tagKey, ttl)
+	}
+	_, err = pipe.Exec()
+	return err
+}
+
+// InvalidateTags implements CacheBackend
+func (r *CacheRedis) InvalidateTags(tags ...string) error {
+	for _, tag := range tags {
+		tagKey := r.prefix + "tag." + tag
+		keys, err := r.redis.SMembers(tagKey).Result()
+		if err != nil {
+			return err
+		}
+		for i := range keys {
+			keys[i] = r.prefix + keys[i]
+		}
+		keys = append(keys, tagKey)
+		err = r.redis.Del(keys...).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package zero
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func cacheTestServe(h *HTTP, method, path string, headers map[string]string) *fasthttp.Response {
+	request := &fasthttp.Request{}
+	request.Header.SetMethod(method)
+	request.SetRequestURI(path)
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(request, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, nil)
+	h.serveCtx(ctx)
+	return &ctx.Response
+}
+
+func TestCacheProtectedRoute(t *testing.T) {
+	h := &HTTP{}
+	h.Authorizer = AuthorizerFunc(func(referenceID int64) (*Principal, error) {
+		return &Principal{ID: referenceID, Scopes: []string{"*"}}, nil
+	})
+	h.OnRequest = func(req *Request) {
+		if req.GetHeader("Authorization") == "Bearer user" {
+			req.ReferenceID = 1
+		}
+	}
+	cache := CacheNew(CacheLRUNew(10), time.Minute)
+	h.Use(cache.Middleware)
+	calls := 0
+	h.Handle("/private", func(req *Request) {
+		calls++
+		req.Write([]byte("secret"))
+	}).RequireScope("read")
+	h.Handle("/public", func(req *Request) {
+		calls++
+		req.Write([]byte("public"))
+	})
+
+	resp := cacheTestServe(h, "GET", "/private", map[string]string{"Authorization": "Bearer user"})
+	if resp.StatusCode() != 200 || string(resp.Body()) != "secret" {
+		t.Fatal(resp.StatusCode(), string(resp.Body()))
+	}
+	resp = cacheTestServe(h, "GET", "/private", nil)
+	if resp.StatusCode() != 401 || string(resp.Header.Peek("X-Cache")) != "" {
+		t.Fatal("anonymous request got cached response", resp.StatusCode(), string(resp.Body()))
+	}
+
+	calls = 0
+	cacheTestServe(h, "GET", "/public", map[string]string{"Cookie": "session=1"})
+	cacheTestServe(h, "GET", "/public", nil)
+	resp = cacheTestServe(h, "GET", "/public", nil)
+	if calls != 2 || string(resp.Header.Peek("X-Cache")) != "HIT" || string(resp.Body()) != "public" {
+		t.Fatal("request with credentials is cached", calls, string(resp.Header.Peek("X-Cache")))
+	}
+}
+
+func TestCacheKeyMethod(t *testing.T) {
+	cache := CacheNew(CacheLRUNew(10), time.Minute)
+	keys := map[string]bool{}
+	for _, method := range []string{"GET", "HEAD"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(method)
+		keys[cache.Key(&Request{Ctx: ctx, Path: "/public"})] = true
+	}
+	if len(keys) != 2 {
+		t.Fatal("HEAD and GET share cache entry", keys)
+	}
+}
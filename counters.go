@@ -0,0 +1,246 @@
+package zero
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// CounterHour bucket is the number of hour since epoch, same as StatHour
+	CounterHour int = iota
+	// CounterDay bucket is the number of day since epoch, same as StatDay
+	CounterDay
+	// CounterMonth bucket is year*100+month, same as StatMonth
+	CounterMonth
+)
+
+// CounterMaxBuckets limits number of buckets read at once, longer ranges should use bigger granularity
+const CounterMaxBuckets = 1000
+
+// ErrCounterRange is returned for ranges longer than CounterMaxBuckets
+var ErrCounterRange = errors.New("counter range is too long")
+
+// CounterPoint is a value of counter in one bucket
+type CounterPoint struct {
+	Bucket int64 `json:"bucket"`
+	Value  int64 `json:"value"`
+}
+
+// Counters stores named counters in redis split by hour, day and month buckets
+type Counters struct {
+	redis *redis.Client
+	// TTL defines how long buckets of every granularity are stored
+	TTL    map[int]time.Duration
+	prefix string
+}
+
+// CountersNew creates counters, hours are stored for a week, days for 400 days and months for 5 years
+func CountersNew(client *redis.Client) *Counters {
+	return &Counters{
+		redis: client,
+		TTL: map[int]time.Duration{
+			CounterHour:  time.Hour * 24 * 7,
+			CounterDay:   time.Hour * 24 * 400,
+			CounterMonth: time.Hour * 24 * 365 * 5,
+		},
+		prefix: "cnt.",
+	}
+}
+
+// CounterBucket return bucket number of granularity for time t
+func CounterBucket(granularity int, t time.Time) int64 {
+	switch granularity {
+	case CounterHour:
+		return t.Unix() / 3600
+	case CounterDay:
+		return t.Unix() / 86400
+	}
+	return int64(t.Year()*100) + int64(t.Month())
+}
+
+// CounterBucketTime return start time of the bucket, hours and days are counted from epoch so they are in UTC
+func CounterBucketTime(granularity int, bucket int64) time.Time {
+	switch granularity {
+	case CounterHour:
+		return time.Unix(bucket*3600, 0).UTC()
+	case CounterDay:
+		return time.Unix(bucket*86400, 0).UTC()
+	}
+	return time.Date(int(bucket/100), time.Month(bucket%100), 1, 0, 0, 0, 0, time.Local)
+}
+
+// counterNext return bucket following passed one
+func counterNext(granularity int, bucket int64) int64 {
+	if granularity != CounterMonth {
+		return bucket + 1
+	}
+	if bucket%100 >= 12 {
+		return (bucket/100+1)*100 + 1
+	}
+	return bucket + 1
+}
+
+// counterBuckets return all buckets from..to inclusive
+func counterBuckets(granularity int, from, to int64) ([]int64, error) {
+	buckets := []int64{}
+	for b := from; b <= to; b = counterNext(granularity, b) {
+		if len(buckets) >= CounterMaxBuckets {
+			return nil, ErrCounterRange
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+func (c *Counters) key(unique bool, name string, granularity int, bucket int64) string {
+	kind := "h"
+	switch granularity {
+	case CounterDay:
+		kind = "d"
+	case CounterMonth:
+		kind = "m"
+	}
+	if unique {
+		kind = "u" + kind
+	}
+	return c.prefix + kind + "." + name + ":" + strconv.FormatInt(bucket, 10)
+}
+
+// Inc increments counter in current hour, day and month buckets
+func (c *Counters) Inc(name string) error {
+	return c.IncBy(name, 1)
+}
+
+// IncBy adds n to counter in current hour, day and month buckets
+func (c *Counters) IncBy(name string, n int64) error {
+	now := time.Now()
+	pipe := c.redis.Pipeline()
+	for _, granularity := range []int{CounterHour, CounterDay, CounterMonth} {
+		key := c.key(false, name, granularity, CounterBucket(granularity, now))
+		pipe.IncrBy(key, n)
+		pipe.Expire(key, c.TTL[granularity])
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// AddUnique counts unique members like user ids using HyperLogLog, error of count is about 0.81%
+func (c *Counters) AddUnique(name string, members ...string) error {
+	if len(members) == 0 {
+		return nil
+	}
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	now := time.Now()
+	pipe := c.redis.Pipeline()
+	for _, granularity := range []int{CounterHour, CounterDay, CounterMonth} {
+		key := c.key(true, name, granularity, CounterBucket(granularity, now))
+		pipe.PFAdd(key, values...)
+		pipe.Expire(key, c.TTL[granularity])
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+// Get return counter value in the bucket
+func (c *Counters) Get(name string, granularity int, bucket int64) (int64, error) {
+	val, err := c.redis.Get(c.key(false, name, granularity, bucket)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return val, err
+}
+
+// Range return counter values for buckets from..to inclusive, missing buckets have zero value
+func (c *Counters) Range(name string, granularity int, from, to int64) ([]CounterPoint, error) {
+	buckets, err := counterBuckets(granularity, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]CounterPoint, len(buckets))
+	if len(buckets) == 0 {
+		return points, nil
+	}
+	keys := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		keys[i] = c.key(false, name, granularity, bucket)
+		points[i].Bucket = bucket
+	}
+	values, err := c.redis.MGet(keys...).Result()
+	if err != nil {
+		return points, err
+	}
+	for i, value := range values {
+		if str, ok := value.(string); ok {
+			points[i].Value = I64(str)
+		}
+	}
+	return points, nil
+}
+
+// UniqueRange return unique count for every bucket from..to inclusive
+func (c *Counters) UniqueRange(name string, granularity int, from, to int64) ([]CounterPoint, error) {
+	buckets, err := counterBuckets(granularity, from, to)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]CounterPoint, len(buckets))
+	pipe := c.redis.Pipeline()
+	cmds := make([]*redis.IntCmd, len(buckets))
+	for i, bucket := range buckets {
+		points[i].Bucket = bucket
+		cmds[i] = pipe.PFCount(c.key(true, name, granularity, bucket))
+	}
+	if len(buckets) == 0 {
+		return points, nil
+	}
+	_, err = pipe.Exec()
+	if err != nil && err != redis.Nil {
+		return points, err
+	}
+	for i, cmd := range cmds {
+		points[i].Value = cmd.Val()
+	}
+	return points, nil
+}
+
+// UniqueTotal return number of unique members during all buckets from..to, like weekly actives from daily buckets
+func (c *Counters) UniqueTotal(name string, granularity int, from, to int64) (int64, error) {
+	buckets, err := counterBuckets(granularity, from, to)
+	if err != nil {
+		return 0, err
+	}
+	if len(buckets) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		keys[i] = c.key(true, name, granularity, bucket)
+	}
+	return c.redis.PFCount(keys...).Result()
+}
+
+// Plot converts points to Plot2D with human readable labels
+func (c *Counters) Plot(granularity int, points []CounterPoint) *Plot2D {
+	layout := "2006-01-02 15:00"
+	switch granularity {
+	case CounterDay:
+		layout = "2006-01-02"
+	case CounterMonth:
+		layout = "2006-01"
+	}
+	plot := Plot2D{
+		Labels: make([]string, len(points)),
+		Points: make([]int64, len(points)),
+	}
+	for i, point := range points {
+		plot.Labels[i] = CounterBucketTime(granularity, point.Bucket).Format(layout)
+		plot.Points[i] = point.Value
+	}
+	return &plot
+}
@@ -0,0 +1,169 @@
+package zero
+
+import (
+	"crypto/subtle"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// CSRF protects cookie authenticated routes against cross site request forgery
+// using double-submit token and Origin/Referer checking for unsafe methods
+type CSRF struct {
+	CookieName     string   // cookie storing the token, "csrf_token" by default
+	HeaderName     string   // header the client should repeat token in, "X-CSRF-Token" by default
+	FieldName      string   // form field alternative to header, "csrf_token" by default
+	TrustedOrigins []string // hosts allowed to send requests besides the host of the server
+	MaxAge         time.Duration
+	Secure         bool // set Secure flag for the cookie, use it with https
+	// Skip allows to disable protection for some requests,
+	// by default only requests from EnvPlatformWeb or requests with cookies are checked
+	Skip   func(req *Request) bool
+	exempt map[*RestAPI]bool
+}
+
+// CSRFNew creates CSRF protection with default settings
+func CSRFNew() *CSRF {
+	return &CSRF{
+		CookieName: "csrf_token",
+		HeaderName: "X-CSRF-Token",
+		FieldName:  "csrf_token",
+		MaxAge:     time.Hour * 24 * 365,
+		exempt:     map[*RestAPI]bool{},
+	}
+}
+
+// csrfDefault is used by token helpers when middleware is not installed
+var csrfDefault = CSRFNew()
+
+// Exempt disables CSRF checks for all routes of passed groups
+func (c *CSRF) Exempt(groups ...*RestAPI) {
+	for _, group := range groups {
+		c.exempt[group] = true
+	}
+}
+
+// Middleware checks unsafe requests, use it with HTTP.Use or RestAPI.Use
+func (c *CSRF) Middleware(req *Request, next func()) {
+	req.csrf = c
+	if req.Group != nil && c.exempt[req.Group] {
+		next()
+		return
+	}
+	if csrfSafeMethod(req.Method()) || !c.needCheck(req) {
+		next()
+		return
+	}
+	if !c.checkOrigin(req) {
+		req.ErrForbidden("csrf_origin", "request origin is not allowed")
+	}
+	cookieToken := req.GetCookie(c.CookieName)
+	token := req.GetHeader(c.HeaderName)
+	if token == "" {
+		token = string(req.Ctx.PostArgs().Peek(c.FieldName))
+	}
+	if token == "" {
+		if mf, err := req.Ctx.MultipartForm(); err == nil {
+			if values := mf.Value[c.FieldName]; len(values) > 0 {
+				token = values[0]
+			}
+		}
+	}
+	if cookieToken == "" || token == "" {
+		req.ErrForbidden("csrf_token", "csrf token is missing")
+	}
+	if subtle.ConstantTimeCompare([]byte(cookieToken), []byte(token)) != 1 {
+		req.ErrForbidden("csrf_token", "csrf token is invalid")
+	}
+	next()
+}
+
+func (c *CSRF) needCheck(req *Request) bool {
+	if c.Skip != nil {
+		return !c.Skip(req)
+	}
+	if req.Env().IsWeb() {
+		return true
+	}
+	return len(req.Ctx.Request.Header.Peek("Cookie")) > 0
+}
+
+// checkOrigin compares Origin or Referer host with request host and trusted origins
+func (c *CSRF) checkOrigin(req *Request) bool {
+	source := req.GetHeader("Origin")
+	if source == "" || source == "null" {
+		source = req.GetHeader("Referer")
+	}
+	if source == "" {
+		// nothing to compare with, token check is still performed
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := strings.ToLower(u.Host)
+	if host == strings.ToLower(string(req.Ctx.Host())) {
+		return true
+	}
+	for _, origin := range c.TrustedOrigins {
+		if strings.ToLower(origin) == host {
+			return true
+		}
+	}
+	return false
+}
+
+func csrfSafeMethod(method string) bool {
+	return OneOf(method, "GET", "HEAD", "OPTIONS", "TRACE")
+}
+
+// CSRFToken returns csrf token of the client, new token is generated and stored in cookie if needed
+func (req *Request) CSRFToken() string {
+	c := req.csrf
+	if c == nil {
+		c = csrfDefault
+	}
+	if req.csrfToken != "" {
+		return req.csrfToken
+	}
+	token := req.GetCookie(c.CookieName)
+	if token == "" {
+		var err error
+		token, err = RandomHex(32)
+		if err != nil {
+			req.ErrServer("csrf_token", err)
+		}
+		cookie := fasthttp.Cookie{}
+		cookie.SetKey(c.CookieName)
+		cookie.SetValue(token)
+		cookie.SetExpire(time.Now().Add(c.MaxAge))
+		cookie.SetPath("/")
+		cookie.SetSecure(c.Secure)
+		cookie.SetSameSite(fasthttp.CookieSameSiteLaxMode)
+		req.Ctx.Response.Header.SetCookie(&cookie)
+	}
+	req.csrfToken = token
+	return token
+}
+
+// CSRFField returns hidden input with csrf token to be placed inside html forms
+func (req *Request) CSRFField() string {
+	c := req.csrf
+	if c == nil {
+		c = csrfDefault
+	}
+	return `<input type="hidden" name="` + html.EscapeString(c.FieldName) + `" value="` + html.EscapeString(req.CSRFToken()) + `">`
+}
+
+// CSRFMeta returns meta tag with csrf token, scripts can read it and pass in header
+func (req *Request) CSRFMeta() string {
+	c := req.csrf
+	if c == nil {
+		c = csrfDefault
+	}
+	return `<meta name="` + html.EscapeString(strings.ToLower(c.HeaderName)) + `" content="` + html.EscapeString(req.CSRFToken()) + `">`
+}
@@ -0,0 +1,174 @@
+package zero
+
+import (
+	"bytes"
+	"runtime"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+var processStarted = time.Now()
+
+// DebugMaxSeconds limits duration of cpu profile and mutex or block sampling
+const DebugMaxSeconds = 120
+
+// debugSampling is 1 while mutex or block sampling window is open
+var debugSampling int32
+
+// DebugRuntime is a snapshot of runtime stats
+type DebugRuntime struct {
+	GoVersion    string  `json:"go_version"`
+	NumCPU       int     `json:"num_cpu"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	Goroutines   int     `json:"goroutines"`
+	Uptime       int64   `json:"uptime"`
+	HeapAlloc    uint64  `json:"heap_alloc"`
+	HeapInuse    uint64  `json:"heap_inuse"`
+	HeapObjects  uint64  `json:"heap_objects"`
+	Sys          uint64  `json:"sys"`
+	TotalAlloc   uint64  `json:"total_alloc"`
+	NumGC        uint32  `json:"num_gc"`
+	PauseTotalNs uint64  `json:"gc_pause_total_ns"`
+	LastPauseNs  uint64  `json:"gc_last_pause_ns"`
+	LastGC       int64   `json:"gc_last"`
+	GCCPU        float64 `json:"gc_cpu_fraction"`
+}
+
+// DebugStreams is a number of currently open long living connections
+type DebugStreams struct {
+	EventSource int64 `json:"event_source"`
+	WebSocket   int64 `json:"websocket"`
+}
+
+// Streams return number of open event source and websocket connections
+func (h *HTTP) Streams() DebugStreams {
+	return DebugStreams{
+		EventSource: atomic.LoadInt64(&h.activeSSE),
+		WebSocket:   atomic.LoadInt64(&h.activeWS),
+	}
+}
+
+// DebugRuntimeStats collects runtime stats
+func DebugRuntimeStats() DebugRuntime {
+	mem := runtime.MemStats{}
+	runtime.ReadMemStats(&mem)
+	return DebugRuntime{
+		GoVersion:    runtime.Version(),
+		NumCPU:       runtime.NumCPU(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		Uptime:       int64(time.Since(processStarted) / time.Second),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		TotalAlloc:   mem.TotalAlloc,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		LastPauseNs:  mem.PauseNs[(mem.NumGC+255)%256],
+		LastGC:       int64(mem.LastGC / uint64(time.Second)),
+		GCCPU:        mem.GCCPUFraction,
+	}
+}
+
+// Debug registers opt-in diagnostics routes under path, every request should pass auth check,
+// nil auth denies all requests. Routes are:
+//
+//	pprof/profile?seconds=N - cpu profile, 30 seconds by default, DebugMaxSeconds at most
+//	pprof/:name?debug=N     - heap, goroutine, mutex, block, allocs or threadcreate profile
+//	runtime                 - runtime stats
+//	routes                  - route table with required permissions
+//	streams                 - number of open event source and websocket connections
+//
+// Mutex and block profiles are empty unless the application enables them with runtime.SetMutexProfileFraction
+// and runtime.SetBlockProfileRate, or request passes seconds=N to sample only during N seconds,
+// rates are restored after the window
+func (h *HTTP) Debug(path string, auth func(req *Request) bool) *RestAPI {
+	api := h.Rest(path)
+	api.Use(func(req *Request, next func()) {
+		if auth == nil || !auth(req) {
+			req.ErrForbidden("debug_forbidden", "debug routes are not allowed")
+		}
+		next()
+	})
+	api.GET("pprof/profile", func(req *Request) {
+		seconds := req.GetParamInt("seconds")
+		if seconds <= 0 {
+			seconds = 30
+		}
+		if seconds > DebugMaxSeconds {
+			seconds = DebugMaxSeconds
+		}
+		buf := bytes.Buffer{}
+		err := pprof.StartCPUProfile(&buf)
+		if err != nil {
+			req.ErrCode(409, "profile_busy", err)
+		}
+		time.Sleep(time.Duration(seconds) * time.Second)
+		pprof.StopCPUProfile()
+		req.respProfile("cpu", buf.Bytes())
+	})
+	api.GET("pprof/:name", func(req *Request) {
+		name := req.GetPathParam("name")
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			req.ErrNotFound("profile_not_found", "unknown profile "+name)
+		}
+		if seconds := req.GetParamInt("seconds"); seconds > 0 && (name == "mutex" || name == "block") {
+			if seconds > DebugMaxSeconds {
+				seconds = DebugMaxSeconds
+			}
+			if !atomic.CompareAndSwapInt32(&debugSampling, 0, 1) {
+				req.ErrCode(409, "profile_busy", "sampling is already running")
+			}
+			debugSample(name, time.Duration(seconds)*time.Second)
+			atomic.StoreInt32(&debugSampling, 0)
+		}
+		debug := req.GetParamInt("debug")
+		if name == "heap" && req.GetParamBool("gc") {
+			runtime.GC()
+		}
+		buf := bytes.Buffer{}
+		err := profile.WriteTo(&buf, debug)
+		if err != nil {
+			req.ErrServer("profile_failed", err)
+		}
+		if debug > 0 {
+			req.Ctx.SetContentType("text/plain; charset=utf8")
+			req.Write(buf.Bytes())
+			return
+		}
+		req.respProfile(name, buf.Bytes())
+	})
+	api.GET("runtime", func(req *Request) {
+		req.Resp(DebugRuntimeStats())
+	})
+	api.GET("routes", func(req *Request) {
+		req.Resp(h.Routes())
+	})
+	api.GET("streams", func(req *Request) {
+		req.Resp(h.Streams())
+	})
+	return api
+}
+
+// debugSample enables mutex or block sampling for the window, then restores previous rate.
+// Block rate could not be read, so it is restored to disabled
+func debugSample(name string, window time.Duration) {
+	if name == "mutex" {
+		previous := runtime.SetMutexProfileFraction(5)
+		time.Sleep(window)
+		runtime.SetMutexProfileFraction(previous)
+		return
+	}
+	runtime.SetBlockProfileRate(int(time.Millisecond))
+	time.Sleep(window)
+	runtime.SetBlockProfileRate(0)
+}
+
+func (req *Request) respProfile(name string, data []byte) {
+	req.SetHeader("Content-Disposition", `attachment; filename="`+name+`.pprof"`)
+	req.SetHeader("X-Content-Type-Options", "nosniff")
+	req.FileBlob(data, "application/octet-stream")
+}
@@ -163,15 +163,10 @@ func (e *Environment) LangToInt() uint8 {
 	}
 }
 
-// IP will return server IP
+// IP will return ip of the user
 func (e *Environment) IP() net.IP {
 	if e.req == nil {
 		return net.ParseIP("127.0.0.1")
 	}
-	ipStr := e.req.GetHeader("X-Real-IP")
-	if ipStr == "" {
-		ipStrFull := e.req.GetHeader("X-Forwarded-For")
-		ipStr, _ = SplitDoubleString(ipStrFull, ",")
-	}
-	return net.ParseIP(ipStr)
+	return e.req.GetRealIP()
 }
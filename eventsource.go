@@ -2,31 +2,60 @@ package zero
 
 import (
 	"bufio"
-	"fmt"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// EventSourceOptions configures event streams, they are set for the server with HTTP.EventSource
+type EventSourceOptions struct {
+	// Heartbeat is an interval of comment lines which keep proxies from closing idle stream, 15 seconds by default, -1 disables them
+	Heartbeat time.Duration
+	// Retry is sent to client as reconnection delay hint if set
+	Retry time.Duration
+	// WriteTimeout is a time client has to accept every event, stream is closed if it is too slow, 30 seconds by default
+	WriteTimeout time.Duration
+}
+
+// ErrStreamClosed is returned when writing to finished event stream
+var ErrStreamClosed = errors.New("event stream is closed")
+
 // ServerEvents wrapper for sending server side events (SSE)
 type ServerEvents struct {
 	Writer    *bufio.Writer
 	EventID   int64
 	SessionID int64
-	Die       chan bool
+	Die       chan bool // closed when client is gone or stream is finished
+	conn      net.Conn
+	timeout   time.Duration
+	err       error
+	ctx       context.Context
+	cancel    context.CancelFunc
+	dieOnce   sync.Once
+	mux       sync.Mutex
 }
 
 func (se *ServerEvents) Write(id int64, eventType string, dataBytes []byte) error {
 	if eventType == "" {
 		eventType = "message"
 	}
-	eventData := fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, dataBytes)
+	buf := strings.Builder{}
 	if id != 0 {
-		eventData = fmt.Sprintf("id: %d\n", id) + eventData
+		buf.WriteString("id: " + strconv.FormatInt(id, 10) + "\n")
 	}
-	_, err := se.Writer.Write([]byte(eventData))
-	if err != nil {
-		return err
+	buf.WriteString("event: " + sseLine(eventType) + "\n")
+	// every line of payload needs own data field, client joins them back with \n
+	data := strings.Replace(string(dataBytes), "\r\n", "\n", -1)
+	data = strings.Replace(data, "\r", "\n", -1)
+	for _, line := range strings.Split(data, "\n") {
+		buf.WriteString("data: " + line + "\n")
 	}
-	se.Writer.Flush()
-	return nil
+	buf.WriteString("\n")
+	return se.write(buf.String())
 }
 
 // Push send event with autoincrement id
@@ -34,3 +63,87 @@ func (se *ServerEvents) Push(eventType string, dataBytes []byte) error {
 	se.EventID++
 	return se.Write(se.EventID, eventType, dataBytes)
 }
+
+// Comment sends comment line, clients ignore it
+func (se *ServerEvents) Comment(text string) error {
+	return se.write(": " + sseLine(text) + "\n\n")
+}
+
+// Retry tells client how long to wait before reconnecting
+func (se *ServerEvents) Retry(delay time.Duration) error {
+	return se.write("retry: " + strconv.FormatInt(int64(delay/time.Millisecond), 10) + "\n\n")
+}
+
+// Err return write error which finished the stream
+func (se *ServerEvents) Err() error {
+	se.mux.Lock()
+	defer se.mux.Unlock()
+	return se.err
+}
+
+// Context return context which is cancelled when stream is finished
+func (se *ServerEvents) Context() context.Context {
+	return se.ctx
+}
+
+// write sends data under the lock, first error finishes the stream
+func (se *ServerEvents) write(data string) error {
+	se.mux.Lock()
+	defer se.mux.Unlock()
+	if se.err != nil {
+		return se.err
+	}
+	if se.conn != nil && se.timeout > 0 {
+		se.conn.SetWriteDeadline(time.Now().Add(se.timeout))
+	}
+	_, err := se.Writer.WriteString(data)
+	if err == nil {
+		err = se.Writer.Flush()
+	}
+	if err != nil {
+		se.err = err
+		se.finish()
+	}
+	return err
+}
+
+// close finishes the stream when callback returns, writer could not be used after that
+func (se *ServerEvents) close() {
+	se.mux.Lock()
+	if se.err == nil {
+		se.err = ErrStreamClosed
+	}
+	se.finish()
+	se.mux.Unlock()
+}
+
+// finish closes Die once
+func (se *ServerEvents) finish() {
+	se.dieOnce.Do(func() {
+		close(se.Die)
+		if se.cancel != nil {
+			se.cancel()
+		}
+	})
+}
+
+// heartbeat sends comments until stream is finished
+func (se *ServerEvents) heartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if se.Comment("ping") != nil {
+				return
+			}
+		case <-se.Die:
+			return
+		}
+	}
+}
+
+// sseLine removes line breaks from single line fields
+func sseLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,264 @@
+package zero
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatExporter receives aggregated counters every Stat period
+type StatExporter interface {
+	// Export adds counter to the current batch, it should not block
+	Export(name string, counter StatCounter, ts time.Time)
+	// Flush sends the batch in background
+	Flush()
+}
+
+// statExporterCloser is implemented by exporters which should send pending batches when Stat is stopped
+type statExporterCloser interface {
+	attach() // called by Stat.AddExporter, exporter is closed when all stats using it are stopped
+	Close()
+}
+
+// StatLineExporter sends counters formatted as text lines over UDP or TCP,
+// lines are packed into packets no bigger than MaxPacket and sent by background goroutine.
+// It is safe to share one exporter between several Stat, their counters are sent in the same batches
+type StatLineExporter struct {
+	MaxPacket int // 1432 bytes by default, fits ethernet MTU
+	network   string
+	addr      string
+	format    func(name string, counter StatCounter, ts time.Time) []string
+	lines     []string
+	queue     chan []string
+	done      chan bool // closed when loop sent all batches
+	conn      net.Conn
+	dropped   int64
+	users     int32 // stats the exporter is added to
+	closed    bool
+	mux       sync.Mutex
+}
+
+// StatLineExporterNew creates exporter with custom format, network is "udp" or "tcp"
+func StatLineExporterNew(network, addr string, format func(name string, counter StatCounter, ts time.Time) []string) *StatLineExporter {
+	e := &StatLineExporter{
+		MaxPacket: 1432,
+		network:   network,
+		addr:      addr,
+		format:    format,
+		queue:     make(chan []string, 16),
+		done:      make(chan bool),
+	}
+	go e.loop()
+	return e
+}
+
+// Export implements StatExporter
+func (e *StatLineExporter) Export(name string, counter StatCounter, ts time.Time) {
+	lines := e.format(name, counter, ts)
+	e.mux.Lock()
+	e.lines = append(e.lines, lines...)
+	e.mux.Unlock()
+}
+
+// Flush implements StatExporter, batch is dropped if sending goroutine is stuck
+func (e *StatLineExporter) Flush() {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	lines := e.lines
+	e.lines = nil
+	if len(lines) == 0 || e.closed {
+		return
+	}
+	select {
+	case e.queue <- lines:
+	default:
+		atomic.AddInt64(&e.dropped, 1)
+	}
+}
+
+func (e *StatLineExporter) attach() {
+	atomic.AddInt32(&e.users, 1)
+}
+
+// Close sends queued batches and the current one and stops background goroutine, it waits till they are sent.
+// Stat.Stop calls it, exporter shared between several Stat is closed when the last of them is stopped
+func (e *StatLineExporter) Close() {
+	if atomic.AddInt32(&e.users, -1) > 0 {
+		return
+	}
+	e.mux.Lock()
+	if e.closed {
+		e.mux.Unlock()
+		<-e.done
+		return
+	}
+	e.closed = true
+	lines := e.lines
+	e.lines = nil
+	e.mux.Unlock()
+	if len(lines) > 0 {
+		e.queue <- lines
+	}
+	close(e.queue)
+	<-e.done
+}
+
+// Dropped return number of batches dropped because network is too slow
+func (e *StatLineExporter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
+
+func (e *StatLineExporter) loop() {
+	defer close(e.done)
+	defer func() {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}()
+	for lines := range e.queue {
+		packet := []byte{}
+		for _, line := range lines {
+			if len(packet) > 0 && len(packet)+len(line)+1 > e.MaxPacket {
+				e.send(packet)
+				packet = []byte{}
+			}
+			packet = append(packet, line...)
+			packet = append(packet, '\n')
+		}
+		if len(packet) > 0 {
+			e.send(packet)
+		}
+	}
+}
+
+// send writes packet reconnecting if needed, errors are only logged
+func (e *StatLineExporter) send(packet []byte) {
+	if e.conn == nil {
+		conn, err := net.DialTimeout(e.network, e.addr, time.Second*5)
+		if err != nil {
+			Err("[STAT] exporter connect failed", e.addr, err)
+			return
+		}
+		e.conn = conn
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	_, err := e.conn.Write(packet)
+	if err != nil {
+		Err("[STAT] exporter write failed", e.addr, err)
+		e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// statValues return values of the counter which are exported, keys are sorted
+func statValues(counter StatCounter) []KV {
+	if counter.IsGauge {
+		return []KV{
+			{"value", strconv.FormatInt(counter.Value, 10)},
+		}
+	}
+	values := []KV{
+		{"count", strconv.FormatInt(counter.Count, 10)},
+	}
+	if counter.Sketch != nil || counter.Elapsed != 0 {
+		values = append(values,
+			KV{"elapsed", strconv.FormatInt(counter.Elapsed, 10)},
+			KV{"max", strconv.FormatInt(counter.MaxElapsed, 10)},
+		)
+	}
+	if counter.Sketch != nil {
+		values = append(values,
+			KV{"mean", strconv.FormatInt(counter.Mean, 10)},
+			KV{"min", strconv.FormatInt(counter.Min, 10)},
+			KV{"p50", strconv.FormatInt(counter.P50, 10)},
+			KV{"p90", strconv.FormatInt(counter.P90, 10)},
+			KV{"p95", strconv.FormatInt(counter.P95, 10)},
+			KV{"p99", strconv.FormatInt(counter.P99, 10)},
+		)
+	}
+	return values
+}
+
+// statName replaces symbols which have special meaning in exporters protocols
+func statName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', ':', '|', '@', '#', ',', '=', '\n':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func sortedKeys(tags S) []string {
+	keys := []string{}
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// StatsDExporterNew sends counters to StatsD over UDP, count is sent as counter and times as gauges,
+// tags are added in DogStatsD format if not empty
+func StatsDExporterNew(addr, prefix string, tags S) *StatLineExporter {
+	suffix := ""
+	if len(tags) > 0 {
+		pairs := []string{}
+		for _, k := range sortedKeys(tags) {
+			pairs = append(pairs, statName(k)+":"+statName(tags[k]))
+		}
+		suffix = "|#" + strings.Join(pairs, ",")
+	}
+	return StatLineExporterNew("udp", addr, func(name string, counter StatCounter, ts time.Time) []string {
+		lines := []string{}
+		for _, v := range statValues(counter) {
+			kind := "g"
+			if v.Key == "count" || v.Key == "elapsed" {
+				kind = "c"
+			}
+			lines = append(lines, prefix+statName(name)+"."+v.Key+":"+v.Value+"|"+kind+suffix)
+		}
+		return lines
+	})
+}
+
+// GraphiteExporterNew sends counters using Graphite plaintext protocol, network is "tcp" or "udp"
+func GraphiteExporterNew(network, addr, prefix string) *StatLineExporter {
+	return StatLineExporterNew(network, addr, func(name string, counter StatCounter, ts time.Time) []string {
+		lines := []string{}
+		unix := strconv.FormatInt(ts.Unix(), 10)
+		for _, v := range statValues(counter) {
+			lines = append(lines, prefix+statName(name)+"."+v.Key+" "+v.Value+" "+unix)
+		}
+		return lines
+	})
+}
+
+// InfluxExporterNew sends counters using InfluxDB line protocol over UDP,
+// every counter is a point of measurement with tag name
+func InfluxExporterNew(addr, measurement string, tags S) *StatLineExporter {
+	tagStr := ""
+	for _, k := range sortedKeys(tags) {
+		tagStr += "," + influxEscape(k) + "=" + influxEscape(tags[k])
+	}
+	return StatLineExporterNew("udp", addr, func(name string, counter StatCounter, ts time.Time) []string {
+		fields := []string{}
+		for _, v := range statValues(counter) {
+			fields = append(fields, v.Key+"="+v.Value+"i")
+		}
+		return []string{influxEscape(measurement) + ",name=" + influxEscape(name) + tagStr + " " + strings.Join(fields, ",") + " " + strconv.FormatInt(ts.UnixNano(), 10)}
+	})
+}
+
+func influxEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, ",", `\,`, -1)
+	s = strings.Replace(s, "=", `\=`, -1)
+	s = strings.Replace(s, " ", `\ `, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
@@ -0,0 +1,110 @@
+package zero
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statListen return address of udp listener, function reading next datagram and closing it
+func statListen(t *testing.T) (string, func() string, func() error) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		t.Helper()
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("no datagram:", err)
+		}
+		return string(buf[:n])
+	}
+	return conn.LocalAddr().String(), read, conn.Close
+}
+
+func TestStatsDExporter(t *testing.T) {
+	addr, read, closeConn := statListen(t)
+	defer closeConn()
+	e := StatsDExporterNew(addr, "app.", S{"env": "prod", "dc": "a:b"})
+	e.Export("db query|users", StatCounter{Count: 3, Elapsed: 30, MaxElapsed: 20}, time.Unix(100, 0))
+	e.Export("conns", StatCounter{Value: 7, IsGauge: true}, time.Unix(100, 0))
+	e.Flush()
+	expected := "app.db_query_users.count:3|c|#dc:a_b,env:prod\n" +
+		"app.db_query_users.elapsed:30|c|#dc:a_b,env:prod\n" +
+		"app.db_query_users.max:20|g|#dc:a_b,env:prod\n" +
+		"app.conns.value:7|g|#dc:a_b,env:prod\n"
+	if got := read(); got != expected {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestInfluxExporter(t *testing.T) {
+	addr, read, closeConn := statListen(t)
+	defer closeConn()
+	e := InfluxExporterNew(addr, "app stat", S{"host": "a,b=c"})
+	e.Export("GET /users", StatCounter{Count: 2}, time.Unix(1, 5))
+	e.Flush()
+	expected := `app\ stat,name=GET\ /users,host=a\,b\=c count=2i 1000000005` + "\n"
+	if got := read(); got != expected {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestGraphiteExporterUDP(t *testing.T) {
+	addr, read, closeConn := statListen(t)
+	defer closeConn()
+	e := GraphiteExporterNew("udp", addr, "app.")
+	e.Export("a b", StatCounter{Count: 1}, time.Unix(42, 0))
+	e.Flush()
+	if got := read(); got != "app.a_b.count 1 42\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestStatLineExporterSplitsPackets(t *testing.T) {
+	addr, read, closeConn := statListen(t)
+	defer closeConn()
+	e := StatLineExporterNew("udp", addr, func(name string, counter StatCounter, ts time.Time) []string {
+		return []string{name}
+	})
+	e.MaxPacket = 20
+	line := strings.Repeat("x", 9) // 10 bytes with new line
+	for i := 0; i < 5; i++ {
+		e.Export(line, StatCounter{}, time.Now())
+	}
+	e.Flush()
+	expected := []string{line + "\n" + line + "\n", line + "\n" + line + "\n", line + "\n"}
+	for i, packet := range expected {
+		if got := read(); got != packet {
+			t.Fatalf("packet %d: got %q, expected %q", i, got, packet)
+		}
+	}
+}
+
+func TestStatStopSendsLastPeriod(t *testing.T) {
+	addr, read, closeConn := statListen(t)
+	defer closeConn()
+	e := GraphiteExporterNew("udp", addr, "")
+	first, second := &Stat{}, &Stat{}
+	first.AddExporter(e)
+	second.AddExporter(e)
+	first.Init(time.Hour, nil)
+	second.Init(time.Hour, nil)
+	first.Inc("a")
+	first.Stop()
+	if got := read(); !strings.HasPrefix(got, "a.count 1 ") {
+		t.Fatalf("got %q", got)
+	}
+	second.Inc("b")
+	second.Stop()
+	if got := read(); !strings.HasPrefix(got, "b.count 1 ") {
+		t.Fatalf("shared exporter is closed by the first stat: %q", got)
+	}
+	e.Export("c", StatCounter{Count: 1}, time.Now())
+	e.Flush() // dropped after close
+}
@@ -5,7 +5,7 @@ go 1.13
 require (
 	github.com/NaySoftware/go-fcm v0.0.0-20190516140123-808e978ddcd2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
-	github.com/fasthttp-contrib/websocket v0.0.0-20160511215533-1f3b11f56072
+	github.com/fasthttp/websocket v1.4.3
 	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/sideshow/apns2 v0.20.0
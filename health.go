@@ -0,0 +1,187 @@
+package zero
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Health collects checks of app components for load balancers
+type Health struct {
+	checks   []healthCheck
+	Timeout  time.Duration // default timeout of a check, 5 seconds if not set
+	draining bool
+	mux      sync.RWMutex
+}
+
+type healthCheck struct {
+	name     string
+	check    func() error
+	timeout  time.Duration
+	liveness bool
+}
+
+// HealthCheckResult is a result of one check
+type HealthCheckResult struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Elapsed int64  `json:"elapsed_ms"`
+}
+
+// HealthReport is a response of health endpoints
+type HealthReport struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+// ErrHealthTimeout returned when check didn't finish in time
+var ErrHealthTimeout = errors.New("check timeout")
+
+// AddCheck registers readiness check, failed check means app should not receive traffic
+func (hl *Health) AddCheck(name string, timeout time.Duration, check func() error) {
+	hl.add(healthCheck{name: name, check: check, timeout: timeout})
+}
+
+// AddLiveCheck registers liveness check, failed check means process should be restarted,
+// liveness checks are also part of readiness
+func (hl *Health) AddLiveCheck(name string, timeout time.Duration, check func() error) {
+	hl.add(healthCheck{name: name, check: check, timeout: timeout, liveness: true})
+}
+
+func (hl *Health) add(check healthCheck) {
+	hl.mux.Lock()
+	hl.checks = append(hl.checks, check)
+	hl.mux.Unlock()
+}
+
+// SetDraining marks app as shutting down, readiness fails after that
+func (hl *Health) SetDraining(draining bool) {
+	hl.mux.Lock()
+	hl.draining = draining
+	hl.mux.Unlock()
+}
+
+// IsDraining return true if app is shutting down
+func (hl *Health) IsDraining() bool {
+	hl.mux.RLock()
+	defer hl.mux.RUnlock()
+	return hl.draining
+}
+
+// Live runs liveness checks
+func (hl *Health) Live() HealthReport {
+	return hl.run(true)
+}
+
+// Ready runs all checks, report fails while app is draining
+func (hl *Health) Ready() HealthReport {
+	report := hl.run(false)
+	if hl.IsDraining() {
+		report.Status = "draining"
+	}
+	return report
+}
+
+// run executes checks in parallel, each one is limited with its timeout
+func (hl *Health) run(onlyLiveness bool) HealthReport {
+	hl.mux.RLock()
+	checks := []healthCheck{}
+	for _, check := range hl.checks {
+		if check.liveness || !onlyLiveness {
+			checks = append(checks, check)
+		}
+	}
+	hl.mux.RUnlock()
+
+	report := HealthReport{
+		Status: "ok",
+		Checks: map[string]HealthCheckResult{},
+	}
+	results := make([]HealthCheckResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check healthCheck) {
+			defer wg.Done()
+			results[i] = hl.runCheck(check)
+		}(i, check)
+	}
+	wg.Wait()
+	for i, check := range checks {
+		report.Checks[check.name] = results[i]
+		if results[i].Status != "ok" {
+			report.Status = "fail"
+		}
+	}
+	return report
+}
+
+func (hl *Health) runCheck(check healthCheck) HealthCheckResult {
+	timeout := check.timeout
+	if timeout == 0 {
+		timeout = hl.Timeout
+	}
+	if timeout == 0 {
+		timeout = time.Second * 5
+	}
+	start := time.Now()
+	done := make(chan error, 1) // buffered so late check doesn't leak goroutine forever
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- errors.New(J("panic: ", r))
+			}
+		}()
+		done <- check.check()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = ErrHealthTimeout
+	}
+	result := HealthCheckResult{
+		Status:  "ok",
+		Elapsed: int64(time.Since(start) / time.Millisecond),
+	}
+	if err != nil {
+		result.Status = "fail"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Names return sorted names of registered checks
+func (hl *Health) Names() []string {
+	hl.mux.RLock()
+	defer hl.mux.RUnlock()
+	names := []string{}
+	for _, check := range hl.checks {
+		names = append(names, check.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (req *Request) respHealth(report HealthReport) {
+	req.SetHeader("Cache-Control", "no-cache")
+	if report.Status != "ok" {
+		req.Ctx.SetStatusCode(503)
+	}
+	req.Resp(report)
+}
+
+// HandleHealth exposes liveness check on /healthz and readiness on /readyz,
+// readiness starts failing when Shutdown is called. Middlewares added with Use are not run for probes
+func (h *HTTP) HandleHealth(health *Health) {
+	h.mux.Lock()
+	h.health = health
+	h.mux.Unlock()
+	h.Handle("/healthz", func(req *Request) {
+		req.respHealth(health.Live())
+	}).bare = true
+	h.Handle("/readyz", func(req *Request) {
+		req.respHealth(health.Ready())
+	}).bare = true
+}
@@ -0,0 +1,338 @@
+package zero
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hub tracks connected sockets by user, session and room and fans messages out to them.
+// Every socket has bounded send buffer, socket which can not keep up is closed instead of slowing down others
+type Hub struct {
+	BufferSize int // pending messages per socket, 256 by default
+	// OnEvict is called when slow socket is closed because its buffer is full
+	OnEvict func(client *HubClient)
+	// OnPresence is called when first socket of the user joins the room or the last one leaves it
+	OnPresence func(room string, userID int64, online bool)
+	clients    map[*HubClient]bool
+	users      map[int64]map[*HubClient]bool
+	sessions   map[int64]map[*HubClient]bool
+	rooms      map[string]map[*HubClient]bool
+	evicted    int64
+	mux        sync.RWMutex
+}
+
+// HubClient is a socket registered in the hub
+type HubClient struct {
+	Socket    *Socket
+	UserID    int64
+	SessionID int64
+	Connected time.Time
+	hub       *Hub
+	send      chan socketFrame
+	rooms     map[string]bool
+}
+
+// HubPresence is a user online in the room
+type HubPresence struct {
+	UserID  int64 `json:"user_id"`
+	Sockets int   `json:"sockets"`
+}
+
+// HubNew creates hub
+func HubNew() *Hub {
+	return &Hub{
+		BufferSize: 256,
+		clients:    map[*HubClient]bool{},
+		users:      map[int64]map[*HubClient]bool{},
+		sessions:   map[int64]map[*HubClient]bool{},
+		rooms:      map[string]map[*HubClient]bool{},
+	}
+}
+
+// Add registers socket, it is removed from the hub with all its rooms when socket is finished
+func (h *Hub) Add(soc *Socket, userID, sessionID int64) *HubClient {
+	client := &HubClient{
+		Socket:    soc,
+		UserID:    userID,
+		SessionID: sessionID,
+		Connected: time.Now(),
+		hub:       h,
+		send:      make(chan socketFrame, h.BufferSize),
+		rooms:     map[string]bool{},
+	}
+	h.mux.Lock()
+	h.clients[client] = true
+	hubIndexAdd(h.users, userID, client)
+	hubIndexAdd(h.sessions, sessionID, client)
+	h.mux.Unlock()
+	go client.pump()
+	return client
+}
+
+func hubIndexAdd(index map[int64]map[*HubClient]bool, id int64, client *HubClient) {
+	if index[id] == nil {
+		index[id] = map[*HubClient]bool{}
+	}
+	index[id][client] = true
+}
+
+func hubIndexRemove(index map[int64]map[*HubClient]bool, id int64, client *HubClient) {
+	delete(index[id], client)
+	if len(index[id]) == 0 {
+		delete(index, id)
+	}
+}
+
+// pump passes buffered messages to the socket until it is finished
+func (c *HubClient) pump() {
+	defer c.hub.remove(c)
+	for {
+		select {
+		case frame := <-c.send:
+			if c.Socket.SendFrame(frame.kind, frame.data) != nil {
+				return
+			}
+		case <-c.Socket.Die:
+			return
+		}
+	}
+}
+
+// remove unregisters client, presence callbacks are called for all its rooms
+func (h *Hub) remove(c *HubClient) {
+	h.mux.Lock()
+	if !h.clients[c] {
+		h.mux.Unlock()
+		return
+	}
+	delete(h.clients, c)
+	hubIndexRemove(h.users, c.UserID, c)
+	hubIndexRemove(h.sessions, c.SessionID, c)
+	left := []string{}
+	for room := range c.rooms {
+		if h.leave(c, room) {
+			left = append(left, room)
+		}
+	}
+	h.mux.Unlock()
+	for _, room := range left {
+		h.OnPresence(room, c.UserID, false)
+	}
+}
+
+// Join adds client to the room
+func (c *HubClient) Join(room string) {
+	h := c.hub
+	h.mux.Lock()
+	if !h.clients[c] || c.rooms[room] {
+		h.mux.Unlock()
+		return
+	}
+	first := !h.userInRoom(c.UserID, room)
+	c.rooms[room] = true
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*HubClient]bool{}
+	}
+	h.rooms[room][c] = true
+	h.mux.Unlock()
+	if first && h.OnPresence != nil {
+		h.OnPresence(room, c.UserID, true)
+	}
+}
+
+// Leave removes client from the room
+func (c *HubClient) Leave(room string) {
+	h := c.hub
+	h.mux.Lock()
+	if !c.rooms[room] {
+		h.mux.Unlock()
+		return
+	}
+	last := h.leave(c, room)
+	h.mux.Unlock()
+	if last {
+		h.OnPresence(room, c.UserID, false)
+	}
+}
+
+// leave removes client from room under the lock, return true if presence callback should be called
+func (h *Hub) leave(c *HubClient, room string) bool {
+	delete(c.rooms, room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+	return h.OnPresence != nil && !h.userInRoom(c.UserID, room)
+}
+
+func (h *Hub) userInRoom(userID int64, room string) bool {
+	for client := range h.rooms[room] {
+		if client.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Rooms return rooms of the client
+func (c *HubClient) Rooms() []string {
+	c.hub.mux.RLock()
+	defer c.hub.mux.RUnlock()
+	rooms := []string{}
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Send sends message to this client only, see Hub.SendAll for message types
+func (c *HubClient) Send(message interface{}) bool {
+	return c.hub.deliver(map[*HubClient]bool{c: true}, message, nil) == 1
+}
+
+// SendAll sends message to every socket, []byte is sent as text as is,
+// other values are encoded with the codec of every socket. Return number of sockets the message is queued for
+func (h *Hub) SendAll(message interface{}, except ...*HubClient) int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.deliver(h.clients, message, except)
+}
+
+// SendRoom sends message to sockets joined the room
+func (h *Hub) SendRoom(room string, message interface{}, except ...*HubClient) int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.deliver(h.rooms[room], message, except)
+}
+
+// SendUser sends message to all sockets of the user
+func (h *Hub) SendUser(userID int64, message interface{}, except ...*HubClient) int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.deliver(h.users[userID], message, except)
+}
+
+// SendSession sends message to all sockets of the session
+func (h *Hub) SendSession(sessionID int64, message interface{}, except ...*HubClient) int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.deliver(h.sessions[sessionID], message, except)
+}
+
+// deliver queues message without blocking, message is encoded once per codec, slow clients are evicted
+func (h *Hub) deliver(clients map[*HubClient]bool, message interface{}, except []*HubClient) int {
+	frames := map[*SocketCodec]socketFrame{}
+	slow := []*HubClient{}
+	sent := 0
+	for client := range clients {
+		if hubExcept(client, except) {
+			continue
+		}
+		frame, ok := frames[client.Socket.Codec]
+		if !ok {
+			if data, isBytes := message.([]byte); isBytes {
+				frame = socketFrame{SocketText, data}
+			} else {
+				data, err := client.Socket.Codec.Marshal(message)
+				if err != nil {
+					Err("[HUB] encode failed", err)
+					continue
+				}
+				frame = socketFrame{client.Socket.Codec.MessageType, data}
+			}
+			frames[client.Socket.Codec] = frame
+		}
+		select {
+		case client.send <- frame:
+			sent++
+		default:
+			slow = append(slow, client)
+		}
+	}
+	for _, client := range slow {
+		go h.evict(client)
+	}
+	return sent
+}
+
+func hubExcept(client *HubClient, except []*HubClient) bool {
+	for _, c := range except {
+		if c == client {
+			return true
+		}
+	}
+	return false
+}
+
+// evict closes slow client, it is removed from the hub by its pump
+func (h *Hub) evict(c *HubClient) {
+	if c.Socket.IsClosed() {
+		return
+	}
+	atomic.AddInt64(&h.evicted, 1)
+	c.Socket.Close(SocketClosePolicyViolation, "slow consumer")
+	if h.OnEvict != nil {
+		h.OnEvict(c)
+	}
+}
+
+// Evicted return number of sockets closed because they were too slow
+func (h *Hub) Evicted() int64 {
+	return atomic.LoadInt64(&h.evicted)
+}
+
+// Count return number of connected sockets
+func (h *Hub) Count() int {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.clients)
+}
+
+// IsOnline return true if user has at least one connected socket
+func (h *Hub) IsOnline(userID int64) bool {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return len(h.users[userID]) > 0
+}
+
+// Users return ids of online users
+func (h *Hub) Users() []int64 {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	users := make([]int64, 0, len(h.users))
+	for userID := range h.users {
+		users = append(users, userID)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i] < users[j] })
+	return users
+}
+
+// Online return users in the room with number of their sockets, sorted by user id
+func (h *Hub) Online(room string) []HubPresence {
+	h.mux.RLock()
+	counts := map[int64]int{}
+	for client := range h.rooms[room] {
+		counts[client.UserID]++
+	}
+	h.mux.RUnlock()
+	result := make([]HubPresence, 0, len(counts))
+	for userID, sockets := range counts {
+		result = append(result, HubPresence{UserID: userID, Sockets: sockets})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+	return result
+}
+
+// UserClients return sockets of the user
+func (h *Hub) UserClients(userID int64) []*HubClient {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	clients := []*HubClient{}
+	for client := range h.users[userID] {
+		clients = append(clients, client)
+	}
+	return clients
+}
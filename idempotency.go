@@ -0,0 +1,316 @@
+package zero
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// IdempotencyRecord is a stored state of request with idempotency key
+type IdempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"` // false while first request is in progress
+	Status      int    `json:"status"`
+	Headers     []KV   `json:"headers"`
+	Body        []byte `json:"body"`
+}
+
+// IdempotencyStore keeps idempotency records
+type IdempotencyStore interface {
+	// Lock creates in progress record if key is free and return nil, otherwise existing record is returned
+	Lock(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error)
+	// Save stores finished response
+	Save(key string, record *IdempotencyRecord, ttl time.Duration) error
+	// Get return record or nil if key is free
+	Get(key string) (*IdempotencyRecord, error)
+	// Release removes record so request can be retried
+	Release(key string) error
+}
+
+// Idempotency is a middleware which replays stored response for retried unsafe requests with the same Idempotency-Key
+type Idempotency struct {
+	Store   IdempotencyStore
+	Header  string        // "Idempotency-Key" by default
+	TTL     time.Duration // how long responses are stored, 24 hours by default
+	LockTTL time.Duration // max time of first request processing, 1 minute by default
+	Wait    time.Duration // how long concurrent duplicates wait for first request, 409 is returned immediately if 0
+}
+
+// IdempotencyNew creates middleware with default settings
+func IdempotencyNew(store IdempotencyStore) *Idempotency {
+	return &Idempotency{
+		Store:   store,
+		Header:  "Idempotency-Key",
+		TTL:     time.Hour * 24,
+		LockTTL: time.Minute,
+	}
+}
+
+// idempotencySkipHeaders are not replayed, they are generated for every response
+var idempotencySkipHeaders = []string{"Content-Length", "Date", "Server", "Connection", "Transfer-Encoding"}
+
+// Middleware implements Middleware
+func (i *Idempotency) Middleware(req *Request, next func()) {
+	idemKey := req.GetHeader(i.Header)
+	if idemKey == "" || !OneOf(req.Method(), "POST", "PUT", "PATCH", "DELETE") {
+		next()
+		return
+	}
+	if len(idemKey) > 255 {
+		req.Err("idempotency_key", "idempotency key is too long")
+	}
+	owner := "i" + req.GetRealIP().String()
+	if req.ReferenceID != 0 {
+		owner = "u" + strconv.FormatInt(req.ReferenceID, 10)
+	} else if req.APIKey != nil {
+		owner = "k" + req.APIKey.ID
+	}
+	key := owner + ":" + idemKey
+	hash := sha256.New()
+	hash.Write([]byte(req.Method() + " " + req.Path + "\n"))
+	hash.Write(req.GetBody())
+	fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+	record, err := i.Store.Lock(key, fingerprint, i.LockTTL)
+	if err != nil {
+		req.ErrServer("idempotency_store", err)
+	}
+	if record != nil {
+		record = i.wait(req, key, record)
+		if record.Fingerprint != fingerprint {
+			req.ErrCode(422, "idempotency_mismatch", "idempotency key was used with another request")
+		}
+		if !record.Done {
+			req.ErrCode(409, "idempotency_conflict", "request with this idempotency key is in progress")
+		}
+		i.replay(req, record)
+		return
+	}
+
+	stored := false
+	defer func() {
+		if !stored {
+			i.Store.Release(key)
+		}
+	}()
+	defer func() {
+		r := recover()
+		if r != nil && fmt.Sprintf("%v", r) != "skip" {
+			panic(r)
+		}
+		stored = i.save(req, key, fingerprint)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	next()
+}
+
+// wait polls store till first request is finished or wait time is over
+func (i *Idempotency) wait(req *Request, key string, record *IdempotencyRecord) *IdempotencyRecord {
+	deadline := time.Now().Add(i.Wait)
+	for !record.Done && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+		current, err := i.Store.Get(key)
+		if err != nil {
+			req.ErrServer("idempotency_store", err)
+		}
+		if current == nil {
+			// first request failed and released the key
+			req.ErrCode(409, "idempotency_conflict", "request with this idempotency key failed, retry")
+		}
+		record = current
+	}
+	return record
+}
+
+// save stores response, server errors and streams are not stored so request could be retried
+func (i *Idempotency) save(req *Request, key, fingerprint string) bool {
+	resp := &req.Ctx.Response
+	if resp.StatusCode() >= 500 || resp.IsBodyStream() {
+		return false
+	}
+	record := IdempotencyRecord{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      resp.StatusCode(),
+		Body:        append([]byte{}, resp.Body()...),
+	}
+	resp.Header.VisitAll(func(k, v []byte) {
+		if !OneOf(string(k), idempotencySkipHeaders...) {
+			record.Headers = append(record.Headers, KV{Key: string(k), Value: string(v)})
+		}
+	})
+	err := i.Store.Save(key, &record, i.TTL)
+	if err != nil {
+		Err("[IDEMPOTENCY] save failed", err)
+		return false
+	}
+	return true
+}
+
+func (i *Idempotency) replay(req *Request, record *IdempotencyRecord) {
+	resp := &req.Ctx.Response
+	resp.SetStatusCode(record.Status)
+	for _, header := range record.Headers {
+		if strings.EqualFold(header.Key, "Content-Type") {
+			resp.Header.SetContentType(header.Value)
+			continue
+		}
+		resp.Header.Add(header.Key, header.Value)
+	}
+	resp.Header.Set("Idempotent-Replayed", "true")
+	resp.SetBody(record.Body)
+}
+
+// IdempotencyMemory stores records in process memory
+type IdempotencyMemory struct {
+	records      map[string]idempotencyMemoryRecord
+	mux          sync.Mutex
+	lastCleaning time.Time
+}
+
+type idempotencyMemoryRecord struct {
+	record  IdempotencyRecord
+	expires time.Time
+}
+
+// IdempotencyMemoryNew creates in-memory store
+func IdempotencyMemoryNew() *IdempotencyMemory {
+	return &IdempotencyMemory{
+		records:      map[string]idempotencyMemoryRecord{},
+		lastCleaning: time.Now(),
+	}
+}
+
+// get should be called under lock
+func (m *IdempotencyMemory) get(key string) *IdempotencyRecord {
+	now := time.Now()
+	if now.Sub(m.lastCleaning) > time.Minute {
+		for k, v := range m.records {
+			if now.After(v.expires) {
+				delete(m.records, k)
+			}
+		}
+		m.lastCleaning = now
+	}
+	item, ok := m.records[key]
+	if !ok || now.After(item.expires) {
+		return nil
+	}
+	record := item.record
+	return &record
+}
+
+// Lock implements IdempotencyStore
+func (m *IdempotencyMemory) Lock(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if record := m.get(key); record != nil {
+		return record, nil
+	}
+	m.records[key] = idempotencyMemoryRecord{
+		record:  IdempotencyRecord{Fingerprint: fingerprint},
+		expires: time.Now().Add(ttl),
+	}
+	return nil, nil
+}
+
+// Save implements IdempotencyStore
+func (m *IdempotencyMemory) Save(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	m.mux.Lock()
+	m.records[key] = idempotencyMemoryRecord{
+		record:  *record,
+		expires: time.Now().Add(ttl),
+	}
+	m.mux.Unlock()
+	return nil
+}
+
+// Get implements IdempotencyStore
+func (m *IdempotencyMemory) Get(key string) (*IdempotencyRecord, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.get(key), nil
+}
+
+// Release implements IdempotencyStore
+func (m *IdempotencyMemory) Release(key string) error {
+	m.mux.Lock()
+	delete(m.records, key)
+	m.mux.Unlock()
+	return nil
+}
+
+// IdempotencyRedis stores records in redis so retries can come to any node
+type IdempotencyRedis struct {
+	redis  *redis.Client
+	prefix string
+}
+
+// IdempotencyRedisNew creates redis store
+func IdempotencyRedisNew(client *redis.Client) *IdempotencyRedis {
+	return &IdempotencyRedis{
+		redis:  client,
+		prefix: "idem.",
+	}
+}
+
+// Lock implements IdempotencyStore
+func (r *IdempotencyRedis) Lock(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, error) {
+	data, err := json.Marshal(IdempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+	ok, err := r.redis.SetNX(r.prefix+key, data, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, nil
+	}
+	record, err := r.Get(key)
+	if err == nil && record == nil {
+		// expired between SETNX and GET, try once more
+		return r.Lock(key, fingerprint, ttl)
+	}
+	return record, err
+}
+
+// Save implements IdempotencyStore
+func (r *IdempotencyRedis) Save(key string, record *IdempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return r.redis.Set(r.prefix+key, data, ttl).Err()
+}
+
+// Get implements IdempotencyStore
+func (r *IdempotencyRedis) Get(key string) (*IdempotencyRecord, error) {
+	data, err := r.redis.Get(r.prefix + key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := IdempotencyRecord{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Release implements IdempotencyStore
+func (r *IdempotencyRedis) Release(key string) error {
+	return r.redis.Del(r.prefix + key).Err()
+}
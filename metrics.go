@@ -0,0 +1,388 @@
+package zero
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricCounter = "counter"
+	metricGauge   = "gauge"
+	metricHisto   = "histogram"
+)
+
+// MetricsDefaultBuckets are histogram buckets in seconds suitable for request latency
+var MetricsDefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics is a registry of metrics exposed in Prometheus text format
+type Metrics struct {
+	families map[string]*metricFamily
+	mux      sync.RWMutex
+}
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+	mux     sync.Mutex
+}
+
+type metricSeries struct {
+	labels  []string
+	value   float64  // counter or gauge value, sum for histogram
+	count   uint64   // histogram observations
+	buckets []uint64 // histogram counts per bucket, not cumulative
+}
+
+// MetricCounter is a monotonically increasing value
+type MetricCounter struct{ family *metricFamily }
+
+// MetricGauge is a value which can go up and down
+type MetricGauge struct{ family *metricFamily }
+
+// MetricHistogram counts observations in buckets
+type MetricHistogram struct{ family *metricFamily }
+
+// MetricsNew creates empty registry
+func MetricsNew() *Metrics {
+	return &Metrics{
+		families: map[string]*metricFamily{},
+	}
+}
+
+// register return existing family with the same name or creates new one,
+// it panics if existing family has another kind, labels or buckets
+func (m *Metrics) register(kind, name, help string, labels []string, buckets []float64) *metricFamily {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	family, ok := m.families[name]
+	if ok {
+		if family.kind != kind {
+			panic("zero: metric " + name + " is already registered as " + family.kind)
+		}
+		if !metricsSameLabels(family.labels, labels) {
+			panic("zero: metric " + name + " is already registered with labels [" + strings.Join(family.labels, ", ") + "]")
+		}
+		if !metricsSameBuckets(family.buckets, buckets) {
+			panic("zero: metric " + name + " is already registered with other buckets")
+		}
+		return family
+	}
+	family = &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+	m.families[name] = family
+	return family
+}
+
+func metricsSameLabels(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func metricsSameBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Counter registers counter with label names
+func (m *Metrics) Counter(name, help string, labels ...string) *MetricCounter {
+	return &MetricCounter{m.register(metricCounter, name, help, labels, nil)}
+}
+
+// Gauge registers gauge with label names
+func (m *Metrics) Gauge(name, help string, labels ...string) *MetricGauge {
+	return &MetricGauge{m.register(metricGauge, name, help, labels, nil)}
+}
+
+// Histogram registers histogram with upper bounds of buckets, MetricsDefaultBuckets are used if nil
+func (m *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *MetricHistogram {
+	if buckets == nil {
+		buckets = MetricsDefaultBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	return &MetricHistogram{m.register(metricHisto, name, help, labels, buckets)}
+}
+
+// with return series for label values, should be called under family lock
+func (f *metricFamily) with(values []string) *metricSeries {
+	if len(values) != len(f.labels) {
+		panic("zero: metric " + f.name + " expects " + strconv.Itoa(len(f.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	series, ok := f.series[key]
+	if !ok {
+		series = &metricSeries{labels: append([]string{}, values...)}
+		if f.kind == metricHisto {
+			series.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = series
+	}
+	return series
+}
+
+// Inc increments counter by one
+func (c *MetricCounter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add increments counter by positive value
+func (c *MetricCounter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	c.family.mux.Lock()
+	c.family.with(labels).value += v
+	c.family.mux.Unlock()
+}
+
+// Set sets gauge value
+func (g *MetricGauge) Set(v float64, labels ...string) {
+	g.family.mux.Lock()
+	g.family.with(labels).value = v
+	g.family.mux.Unlock()
+}
+
+// Add adds value to gauge, could be negative
+func (g *MetricGauge) Add(v float64, labels ...string) {
+	g.family.mux.Lock()
+	g.family.with(labels).value += v
+	g.family.mux.Unlock()
+}
+
+// Inc increments gauge by one
+func (g *MetricGauge) Inc(labels ...string) {
+	g.Add(1, labels...)
+}
+
+// Dec decrements gauge by one
+func (g *MetricGauge) Dec(labels ...string) {
+	g.Add(-1, labels...)
+}
+
+// Observe adds observation to histogram
+func (h *MetricHistogram) Observe(v float64, labels ...string) {
+	h.family.mux.Lock()
+	series := h.family.with(labels)
+	series.value += v
+	series.count++
+	for i, bound := range h.family.buckets {
+		if v <= bound {
+			series.buckets[i]++
+			break
+		}
+	}
+	h.family.mux.Unlock()
+}
+
+// ObserveDuration adds time passed since start in seconds
+func (h *MetricHistogram) ObserveDuration(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// WriteText writes all metrics in Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mux.RLock()
+	names := []string{}
+	for name := range m.families {
+		names = append(names, name)
+	}
+	m.mux.RUnlock()
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		m.mux.RLock()
+		family := m.families[name]
+		m.mux.RUnlock()
+		family.write(out)
+	}
+	return out.Flush()
+}
+
+func (f *metricFamily) write(out *bufio.Writer) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if f.help != "" {
+		out.WriteString("# HELP " + f.name + " " + metricEscape(f.help, false) + "\n")
+	}
+	out.WriteString("# TYPE " + f.name + " " + f.kind + "\n")
+	keys := []string{}
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := f.series[key]
+		if f.kind != metricHisto {
+			out.WriteString(f.name + metricLabels(f.labels, series.labels, "", "") + " " + metricFloat(series.value) + "\n")
+			continue
+		}
+		cumulative := uint64(0)
+		for i, bound := range f.buckets {
+			cumulative += series.buckets[i]
+			out.WriteString(f.name + "_bucket" + metricLabels(f.labels, series.labels, "le", metricFloat(bound)) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		out.WriteString(f.name + "_bucket" + metricLabels(f.labels, series.labels, "le", "+Inf") + " " + strconv.FormatUint(series.count, 10) + "\n")
+		out.WriteString(f.name + "_sum" + metricLabels(f.labels, series.labels, "", "") + " " + metricFloat(series.value) + "\n")
+		out.WriteString(f.name + "_count" + metricLabels(f.labels, series.labels, "", "") + " " + strconv.FormatUint(series.count, 10) + "\n")
+	}
+}
+
+func metricLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+metricEscape(values[i], true)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func metricEscape(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func metricFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// StatCallback return callback for Stat.Init which exports every flushed counter as gauges
+// <prefix>_count, <prefix>_elapsed and <prefix>_max_elapsed with label name, stat gauges are exported as <prefix>_value
+func (m *Metrics) StatCallback(prefix string) func(string, StatCounter) {
+	count := m.Gauge(prefix+"_count", "number of events during last stat period", "name")
+	elapsed := m.Gauge(prefix+"_elapsed", "sum of elapsed time during last stat period", "name")
+	maxElapsed := m.Gauge(prefix+"_max_elapsed", "max elapsed time during last stat period", "name")
+	value := m.Gauge(prefix+"_value", "last value of stat gauge", "name")
+	return func(name string, counter StatCounter) {
+		if counter.IsGauge {
+			value.Set(float64(counter.Value), name)
+			return
+		}
+		count.Set(float64(counter.Count), name)
+		elapsed.Set(float64(counter.Elapsed), name)
+		maxElapsed.Set(float64(counter.MaxElapsed), name)
+	}
+}
+
+// HTTPMetrics is a middleware collecting per route request metrics
+type HTTPMetrics struct {
+	requests *MetricCounter
+	duration *MetricHistogram
+	inFlight *MetricGauge
+}
+
+// HTTPMetrics creates request metrics in the registry
+func (m *Metrics) HTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{
+		requests: m.Counter("http_requests_total", "number of handled http requests", "method", "route", "status"),
+		duration: m.Histogram("http_request_duration_seconds", "http request latency", nil, "method", "route"),
+		inFlight: m.Gauge("http_requests_in_flight", "number of requests being handled"),
+	}
+}
+
+// Middleware implements Middleware
+func (hm *HTTPMetrics) Middleware(req *Request, next func()) {
+	route := req.Path
+	if req.Route != nil {
+		route = req.Route.Path
+	}
+	method := req.Method()
+	start := time.Now()
+	hm.inFlight.Inc()
+	defer func() {
+		r := recover()
+		hm.inFlight.Dec()
+		status := req.Ctx.Response.StatusCode()
+		if r != nil && J(r) != "skip" {
+			status = 500 // server responds with 500 after the panic is recovered
+		}
+		hm.requests.Inc(method, route, strconv.Itoa(status))
+		hm.duration.ObserveDuration(start, method, route)
+		if r != nil {
+			panic(r)
+		}
+	}()
+	next()
+}
+
+// HandleMetrics exposes registry on path in Prometheus text format
+func (h *HTTP) HandleMetrics(path string, m *Metrics) *Route {
+	return h.Handle(path, func(req *Request) {
+		req.Ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+		err := m.WriteText(req.Ctx.Response.BodyWriter())
+		if err != nil {
+			req.ErrServer("metrics", err)
+		}
+	})
+}
+
+// zeroMetrics are metrics of internal subsystems
+type zeroMetrics struct {
+	queuePublished *MetricCounter
+	queueDelivered *MetricCounter
+	queueDropped   *MetricCounter
+	wsConnections  *MetricGauge
+	wsMessages     *MetricCounter
+	pushSent       *MetricCounter
+}
+
+var internalMetrics *zeroMetrics
+
+// MetricsEnable turns on metrics of Queue, websockets and push notifications, call it before serving
+func MetricsEnable(m *Metrics) {
+	internalMetrics = &zeroMetrics{
+		queuePublished: m.Counter("zero_queue_published_total", "number of events published to queue"),
+		queueDelivered: m.Counter("zero_queue_delivered_total", "number of events delivered to local subscribers"),
+		queueDropped:   m.Counter("zero_queue_dropped_total", "number of events dropped because subscriber channel is full"),
+		wsConnections:  m.Gauge("zero_websocket_connections", "number of open websocket connections"),
+		wsMessages:     m.Counter("zero_websocket_messages_total", "number of websocket messages", "direction"),
+		pushSent:       m.Counter("zero_push_sent_total", "number of push notifications sent", "platform", "result"),
+	}
+}
@@ -0,0 +1,48 @@
+package zero
+
+// Middleware wraps request handling, it should call next to pass request further
+// or stop the chain using one of req.Err* methods
+type Middleware func(req *Request, next func())
+
+// Use adds middlewares executed for every route of the server
+func (h *HTTP) Use(middlewares ...Middleware) {
+	h.middlewares = append(h.middlewares, middlewares...)
+}
+
+// Use adds middlewares executed only for routes of this group
+func (r *RestAPI) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
+// runMiddlewares executes middlewares one by one and calls handler in the end
+func runMiddlewares(req *Request, middlewares []Middleware, handler func(req *Request)) {
+	if len(middlewares) == 0 {
+		handler(req)
+		return
+	}
+	middlewares[0](req, func() {
+		runMiddlewares(req, middlewares[1:], handler)
+	})
+}
+
+// handle runs server and group middlewares around the route handler,
+// route permissions are checked after all middlewares so they can authenticate request
+func (h *HTTP) handle(req *Request, handler func(req *Request)) {
+	if req.Route != nil && req.Route.bare {
+		handler(req)
+		return
+	}
+	middlewares := h.middlewares
+	if req.Group != nil && len(req.Group.middlewares) > 0 {
+		middlewares = append(append([]Middleware{}, h.middlewares...), req.Group.middlewares...)
+	}
+	if req.Route != nil && req.Route.IsProtected() {
+		route := req.Route
+		callback := handler
+		handler = func(req *Request) {
+			req.authorize(route)
+			callback(req)
+		}
+	}
+	runMiddlewares(req, middlewares, handler)
+}
@@ -0,0 +1,149 @@
+package zero
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type msgPackItem struct {
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags"`
+	Attrs map[string]string `json:"attrs"`
+	Score float64           `json:"score"`
+	Next  *msgPackItem      `json:"next,omitempty"`
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	bigMap := map[string]int{}
+	for i := 0; i < 20; i++ {
+		bigMap[J("k", i)] = i
+	}
+	cases := []struct {
+		name  string
+		value interface{}
+	}{
+		{"bool", true},
+		{"false", false},
+		{"fixint", 7},
+		{"negative fixint", -5},
+		{"int8", -100},
+		{"uint8", 200},
+		{"int16", -30000},
+		{"int32", int32(math.MinInt32)},
+		{"int64", int64(math.MaxInt64)},
+		{"uint64", uint64(math.MaxUint64)},
+		{"float", 1.5},
+		{"empty string", ""},
+		{"fixstr", strings.Repeat("a", 31)},
+		{"str8", strings.Repeat("b", 255)},
+		{"str16", strings.Repeat("c", 65535)},
+		{"str32", strings.Repeat("d", 65536)},
+		{"unicode", "привет, 世界"},
+		{"empty array", []int{}},
+		{"fixarray", []int{1, 2, 3}},
+		{"array16", make([]int, 16)},
+		{"array32", make([]bool, 65536)},
+		{"fixmap", map[string]string{"a": "b"}},
+		{"map16", bigMap},
+		{"struct", msgPackItem{Name: "x", Tags: []string{"a"}, Attrs: map[string]string{"k": "v"}, Score: -0.25, Next: &msgPackItem{Name: "y"}}},
+	}
+	for _, c := range cases {
+		data, err := MsgPackMarshal(c.value)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		decoded := reflect.New(reflect.TypeOf(c.value))
+		err = MsgPackUnmarshal(data, decoded.Interface())
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if !reflect.DeepEqual(decoded.Elem().Interface(), c.value) {
+			t.Fatalf("%s: got %v", c.name, decoded.Elem().Interface())
+		}
+	}
+}
+
+func TestMsgPackDecode(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		expected interface{}
+	}{
+		{"nil", []byte{0xc0}, nil},
+		{"uint8", []byte{0xcc, 0xff}, float64(255)},
+		{"uint16", []byte{0xcd, 0x01, 0x00}, float64(256)},
+		{"int16", []byte{0xd1, 0xff, 0x00}, float64(-256)},
+		{"float32", []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{"bin8 as base64", []byte{0xc4, 0x02, 'h', 'i'}, "aGk="},
+		{"map with int key", []byte{0x81, 0x01, 0xa1, 'x'}, map[string]interface{}{"1": "x"}},
+	}
+	for _, c := range cases {
+		var v interface{}
+		err := MsgPackUnmarshal(c.data, &v)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if !reflect.DeepEqual(v, c.expected) {
+			t.Fatalf("%s: got %#v, expected %#v", c.name, v, c.expected)
+		}
+	}
+}
+
+func TestMsgPackInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", []byte{}, ErrMsgPack},
+		{"ext", []byte{0xd4, 0x01, 0x00}, ErrMsgPack},
+		{"never used", []byte{0xc1}, ErrMsgPack},
+		{"trailing bytes", []byte{0xc0, 0xc0}, ErrMsgPack},
+		{"array longer than data", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}, ErrMsgPack},
+		{"map longer than data", []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0xc0}, ErrMsgPack},
+		{"str longer than data", []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}, ErrMsgPack},
+		{"deep arrays", append(bytes.Repeat([]byte{0x91}, 8<<20), 0xc0), ErrMsgPackDepth},
+		{"deep maps", append(bytes.Repeat([]byte{0x81, 0xa1, 'a'}, MsgPackMaxDepth+1), 0xc0), ErrMsgPackDepth},
+	}
+	for _, c := range cases {
+		var v interface{}
+		if err := MsgPackUnmarshal(c.data, &v); err != c.err {
+			t.Fatalf("%s: got %v, expected %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestMsgPackMaxDepth(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, MsgPackMaxDepth), 0xc0)
+	var v interface{}
+	if err := MsgPackUnmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+	data = append(bytes.Repeat([]byte{0x91}, MsgPackMaxDepth+1), 0xc0)
+	if err := MsgPackUnmarshal(data, &v); err != ErrMsgPackDepth {
+		t.Fatal(err)
+	}
+}
+
+func TestMsgPackTruncated(t *testing.T) {
+	values := []interface{}{
+		int64(math.MaxInt64), -30000, 1.5, strings.Repeat("s", 300),
+		[]interface{}{1, "a", nil, []int{1, 2}},
+		msgPackItem{Name: "x", Tags: []string{"a", "b"}, Attrs: map[string]string{"k": "v"}},
+	}
+	for _, value := range values {
+		data, err := MsgPackMarshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < len(data); n++ {
+			var v interface{}
+			if err := MsgPackUnmarshal(data[:n], &v); err != ErrMsgPack {
+				t.Fatalf("%v cut to %d bytes: got %v", value, n, err)
+			}
+		}
+	}
+}
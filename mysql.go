@@ -2,6 +2,7 @@ package zero
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
@@ -11,7 +12,23 @@ import (
 
 // MySQL is main class for managing db
 type MySQL struct {
-	db *sql.DB
+	db   *sql.DB
+	span *Span
+}
+
+// Trace return copy of the connection which records every query as child span of the parent
+func (c *MySQL) Trace(parent *Span) *MySQL {
+	return &MySQL{db: c.db, span: parent}
+}
+
+// startSpan starts query span, return nil if connection is not traced
+func (c *MySQL) startSpan(operation, table, query string) *Span {
+	span := c.span.Child("mysql."+operation+" "+table, SpanKindClient)
+	span.SetAttr("db.system", "mysql").SetAttr("db.operation", operation).SetAttr("db.statement", query)
+	if table != "" {
+		span.SetAttr("db.sql.table", table)
+	}
+	return span
 }
 
 func (c *MySQL) scanFields(prefix string, obj interface{}, values []interface{}, queryTypes, queryQueries []string, len int) ([]interface{}, []string, []string, int) {
@@ -75,7 +92,10 @@ func (c *MySQL) Insert(table string, obj interface{}) error {
 	values, queryTypes, queryQueries := c.inspect(obj, nil)
 
 	sql := "INSERT INTO " + table + " (" + strings.Join(queryTypes, ", ") + ") VALUES (" + strings.Join(queryQueries, ", ") + ")"
+	span := c.startSpan("insert", table, sql)
 	_, err := c.db.Exec(sql, values...)
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
 		fmt.Println("error:", sql, err)
 	} else {
@@ -89,7 +109,10 @@ func (c *MySQL) Replace(table string, obj interface{}) error {
 	values, queryTypes, queryQueries := c.inspect(obj, nil)
 
 	sql := "REPLACE INTO " + table + " (" + strings.Join(queryTypes, ", ") + ") VALUES (" + strings.Join(queryQueries, ", ") + ")"
+	span := c.startSpan("replace", table, sql)
 	_, err := c.db.Exec(sql, values...)
+	span.SetError(err)
+	span.Finish()
 	if err != nil {
 		fmt.Println("error:", sql, err)
 	} else {
@@ -106,15 +129,32 @@ func (c *MySQL) Update(table string, obj interface{}, checkField string, checkVa
 	}
 	sql := "UPDATE " + table + " SET " + strings.Join(queryTypes, ", ") + " WHERE " + checkField
 	fmt.Println("sql", sql)
+	span := c.startSpan("update", table, sql)
 	_, err := c.db.Exec(sql, values...)
+	span.SetError(err)
+	span.Finish()
 	fmt.Println("error", err)
 }
 
-// QueryRow allow fetch any data
+// QueryRow allow fetch any data, span of traced connection does not include Scan, use QueryRowScan to record row errors
 func (c *MySQL) QueryRow(sql string, values ...interface{}) *sql.Row {
+	span := c.startSpan("query", "", sql)
+	defer span.Finish()
 	return c.db.QueryRow(sql, values...)
 }
 
+// QueryRowScan fetches one row into dest, span of traced connection includes Scan and its error.
+// sql.ErrNoRows is returned but not recorded as span error
+func (c *MySQL) QueryRowScan(query string, values []interface{}, dest ...interface{}) error {
+	span := c.startSpan("query", "", query)
+	err := c.db.QueryRow(query, values...).Scan(dest...)
+	if err != sql.ErrNoRows {
+		span.SetError(err)
+	}
+	span.Finish()
+	return err
+}
+
 // Connect connects to db
 func (c *MySQL) Connect(initStr string) {
 	db, err := sql.Open("mysql", initStr)
@@ -123,3 +163,11 @@ func (c *MySQL) Connect(initStr string) {
 	}
 	c.db = db
 }
+
+// HealthCheck pings database, use it with Health.AddCheck
+func (c *MySQL) HealthCheck() error {
+	if c.db == nil {
+		return errors.New("mysql is not connected")
+	}
+	return c.db.Ping()
+}
@@ -35,6 +35,8 @@ type Push struct {
 	// Sender is prefix which whould be placed before Text field, like Sender: Text on ios, and as separate field on android
 	Sender string
 	Silent bool
+	// Span is a parent for the send span, nil disables tracing
+	Span *Span
 }
 
 type apnsAlert struct {
@@ -51,7 +53,21 @@ type apnsMessage struct {
 }
 
 // Send send push to the device
-func (push *Push) Send(platform, deviceToken string, sandbox, voip bool) error {
+func (push *Push) Send(platform, deviceToken string, sandbox, voip bool) (err error) {
+	span := push.Span.Child("push.send", SpanKindClient).SetAttr("push.platform", platform).SetAttr("push.type", push.Type)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	if internalMetrics != nil {
+		defer func() {
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			internalMetrics.pushSent.Inc(platform, result)
+		}()
+	}
 	if platform == "android" {
 		client := fcm.NewFcmClient(androidServerKey)
 		client.SetPriority(fcm.Priority_HIGH)
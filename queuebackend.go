@@ -0,0 +1,335 @@
+package zero
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// QueueMessage is a message received by pattern subscription
+type QueueMessage struct {
+	Channel string
+	Payload string
+}
+
+// QueueSubscription is an active pattern subscription
+type QueueSubscription interface {
+	// Channel return messages, it is closed when subscription is closed
+	Channel() <-chan QueueMessage
+	Close() error
+}
+
+// QueueBackend delivers Queue events between nodes and stores their history
+type QueueBackend interface {
+	// Publish sends payload to subscribers of patterns matching the channel, it does not wait for slow subscribers:
+	// their subscription is closed when its buffer is full, like redis does with client-output-buffer-limit,
+	// so ListenAll reconnects and restores missed events from history
+	Publish(channel, payload string) error
+	// PSubscribe subscribes to channels matching glob pattern, it returns after subscription is confirmed
+	PSubscribe(pattern string) (QueueSubscription, error)
+	// Append adds payload to the end of history list and return its new length
+	Append(key, payload string) (int64, error)
+	// Trim keeps only last items of history list, all items are removed if keep is 0 or less
+	Trim(key string, keep int64) error
+	// Range return items of history list from start to stop inclusive, negative indexes count from the end like in LRANGE
+	Range(key string, start, stop int64) ([]string, error)
+	// Ping checks backend is available
+	Ping() error
+}
+
+// QueueRedis is a queue backend on redis pub/sub and lists
+type QueueRedis struct {
+	redis *redis.Client
+}
+
+// QueueRedisNew creates redis backend
+func QueueRedisNew(client *redis.Client) *QueueRedis {
+	return &QueueRedis{redis: client}
+}
+
+// Publish implements QueueBackend
+func (r *QueueRedis) Publish(channel, payload string) error {
+	return r.redis.Publish(channel, payload).Err()
+}
+
+// PSubscribe implements QueueBackend
+func (r *QueueRedis) PSubscribe(pattern string) (QueueSubscription, error) {
+	pubsub := r.redis.PSubscribe(pattern)
+	_, err := pubsub.Receive()
+	if err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	sub := &queueRedisSub{pubsub: pubsub, ch: make(chan QueueMessage, 100)}
+	go sub.receive()
+	return sub, nil
+}
+
+// receive passes messages until connection fails, channel is closed then, so listener knows messages could be lost.
+// pubsub.Channel() is not used because it reconnects silently
+func (s *queueRedisSub) receive() {
+	defer close(s.ch)
+	pinged := false
+	for {
+		msg, err := s.pubsub.ReceiveTimeout(time.Second * 30)
+		if err != nil {
+			// idle connection is checked with ping, it is dead if pong does not come in time
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !pinged && s.pubsub.Ping() == nil {
+				pinged = true
+				continue
+			}
+			return
+		}
+		pinged = false
+		if m, ok := msg.(*redis.Message); ok {
+			s.ch <- QueueMessage{Channel: m.Channel, Payload: m.Payload}
+		}
+	}
+}
+
+type queueRedisSub struct {
+	pubsub *redis.PubSub
+	ch     chan QueueMessage
+}
+
+func (s *queueRedisSub) Channel() <-chan QueueMessage {
+	return s.ch
+}
+
+func (s *queueRedisSub) Close() error {
+	return s.pubsub.Close()
+}
+
+// Append implements QueueBackend
+func (r *QueueRedis) Append(key, payload string) (int64, error) {
+	return r.redis.RPush(key, payload).Result()
+}
+
+// Trim implements QueueBackend
+func (r *QueueRedis) Trim(key string, keep int64) error {
+	if keep <= 0 { // LTRIM key -0 -1 would keep the whole list
+		return r.redis.Del(key).Err()
+	}
+	return r.redis.LTrim(key, -keep, -1).Err()
+}
+
+// Range implements QueueBackend
+func (r *QueueRedis) Range(key string, start, stop int64) ([]string, error) {
+	return r.redis.LRange(key, start, stop).Result()
+}
+
+// Ping implements QueueBackend
+func (r *QueueRedis) Ping() error {
+	return r.redis.Ping().Err()
+}
+
+// QueueMemory is an in-process queue backend for single node deployments and tests,
+// subscription is closed if it has QueueMemoryBuffer unread messages like redis closes slow clients
+type QueueMemory struct {
+	lists   map[string][]string
+	subs    map[*queueMemorySub]bool
+	dropped int64
+	mux     sync.RWMutex
+}
+
+// QueueMemoryBuffer is a number of messages kept for memory subscription
+const QueueMemoryBuffer = 1000
+
+// QueueMemoryNew creates in-process backend
+func QueueMemoryNew() *QueueMemory {
+	return &QueueMemory{
+		lists: map[string][]string{},
+		subs:  map[*queueMemorySub]bool{},
+	}
+}
+
+type queueMemorySub struct {
+	m       *QueueMemory
+	pattern string
+	ch      chan QueueMessage
+}
+
+func (s *queueMemorySub) Channel() <-chan QueueMessage {
+	return s.ch
+}
+
+func (s *queueMemorySub) Close() error {
+	s.m.mux.Lock()
+	defer s.m.mux.Unlock()
+	if s.m.subs[s] {
+		delete(s.m.subs, s)
+		close(s.ch)
+	}
+	return nil
+}
+
+// Publish implements QueueBackend
+func (m *QueueMemory) Publish(channel, payload string) error {
+	slow := []*queueMemorySub{}
+	m.mux.RLock()
+	for sub := range m.subs {
+		if !queueGlobMatch(sub.pattern, channel) {
+			continue
+		}
+		select {
+		case sub.ch <- QueueMessage{Channel: channel, Payload: payload}:
+		default:
+			atomic.AddInt64(&m.dropped, 1)
+			slow = append(slow, sub)
+		}
+	}
+	m.mux.RUnlock()
+	for _, sub := range slow {
+		sub.Close()
+	}
+	return nil
+}
+
+// Dropped return number of messages not delivered to slow subscribers before their subscription was closed
+func (m *QueueMemory) Dropped() int64 {
+	return atomic.LoadInt64(&m.dropped)
+}
+
+// PSubscribe implements QueueBackend
+func (m *QueueMemory) PSubscribe(pattern string) (QueueSubscription, error) {
+	sub := &queueMemorySub{m: m, pattern: pattern, ch: make(chan QueueMessage, QueueMemoryBuffer)}
+	m.mux.Lock()
+	m.subs[sub] = true
+	m.mux.Unlock()
+	return sub, nil
+}
+
+// Append implements QueueBackend
+func (m *QueueMemory) Append(key, payload string) (int64, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.lists[key] = append(m.lists[key], payload)
+	return int64(len(m.lists[key])), nil
+}
+
+// Trim implements QueueBackend
+func (m *QueueMemory) Trim(key string, keep int64) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	list := m.lists[key]
+	if keep <= 0 {
+		delete(m.lists, key)
+	} else if int64(len(list)) > keep {
+		m.lists[key] = append([]string{}, list[int64(len(list))-keep:]...)
+	}
+	return nil
+}
+
+// Range implements QueueBackend
+func (m *QueueMemory) Range(key string, start, stop int64) ([]string, error) {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	list := m.lists[key]
+	n := int64(len(list))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}, nil
+	}
+	return append([]string{}, list[start:stop+1]...), nil
+}
+
+// Ping implements QueueBackend
+func (m *QueueMemory) Ping() error {
+	return nil
+}
+
+// queueGlobMatch matches channel with redis glob pattern supporting *, ?, [abc], [^a], [a-z] and \ escape
+func queueGlobMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if queueGlobMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := 1
+			for end < len(pattern) && pattern[end] != ']' {
+				if pattern[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(pattern) { // no closing bracket, match literally
+				if s[0] != '[' {
+					return false
+				}
+			} else {
+				if !queueGlobClass(pattern[1:end], s[0]) {
+					return false
+				}
+				pattern = pattern[end:]
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func queueGlobClass(class string, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	match := false
+	for i := 0; i < len(class); i++ {
+		if class[i] == '\\' && i+1 < len(class) {
+			i++
+			match = match || class[i] == c
+		} else if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			match = match || (c >= lo && c <= hi)
+			i += 2
+		} else {
+			match = match || class[i] == c
+		}
+	}
+	return match != negate
+}
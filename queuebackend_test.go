@@ -0,0 +1,169 @@
+package zero
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueueGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "q.chat.1", true},
+		{"q.*", "q.chat.1", true},
+		{"q.*", "x.chat", false},
+		{"q.*.1", "q.chat.1", true},
+		{"q.*.1", "q.chat.2", false},
+		{"*a*b*c", "xaybzc", true},
+		{"*a*b*c", "xaybzcd", false},
+		{"a**b", "ab", true},
+		{"*.*.1", "q.a.b.1", true}, // first star backtracks past the first dot
+		{"?", "", false},
+		{"q.?", "q.a", true},
+		{"q.?", "q.ab", false},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[^abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[a-c]x", "bx", true},
+		{"[c-a]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{"[\\]]", "]", true},
+		{"[abc", "[abc", true},
+		{"[abc", "a", false},
+		{"\\*", "*", true},
+		{"\\*", "a", false},
+		{"a\\?", "a?", true},
+		{"a\\?", "ab", false},
+		{"\\", "\\", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+	for _, c := range cases {
+		if queueGlobMatch(c.pattern, c.s) != c.match {
+			t.Fatalf("%q with %q: expected %v", c.pattern, c.s, c.match)
+		}
+	}
+}
+
+func TestQueueMemoryRange(t *testing.T) {
+	m := QueueMemoryNew()
+	for _, item := range []string{"a", "b", "c", "d"} {
+		m.Append("k", item)
+	}
+	cases := []struct {
+		start, stop int64
+		expected    []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d"}},
+		{0, 1, []string{"a", "b"}},
+		{-2, -1, []string{"c", "d"}},
+		{-10, 1, []string{"a", "b"}},
+		{2, 10, []string{"c", "d"}},
+		{-1, -2, []string{}},
+		{5, 10, []string{}},
+	}
+	for _, c := range cases {
+		items, err := m.Range("k", c.start, c.stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(items, c.expected) {
+			t.Fatalf("range %d %d: got %v, expected %v", c.start, c.stop, items, c.expected)
+		}
+	}
+	items, _ := m.Range("missing", 0, -1)
+	if len(items) != 0 {
+		t.Fatal(items)
+	}
+}
+
+func TestQueueMemoryTrim(t *testing.T) {
+	m := QueueMemoryNew()
+	for _, item := range []string{"a", "b", "c"} {
+		m.Append("k", item)
+	}
+	m.Trim("k", 5)
+	if items, _ := m.Range("k", 0, -1); len(items) != 3 {
+		t.Fatal(items)
+	}
+	m.Trim("k", 2)
+	if items, _ := m.Range("k", 0, -1); !reflect.DeepEqual(items, []string{"b", "c"}) {
+		t.Fatal(items)
+	}
+	m.Trim("k", 0)
+	if items, _ := m.Range("k", 0, -1); len(items) != 0 {
+		t.Fatal(items)
+	}
+	m.Append("k", "d")
+	m.Trim("k", -1)
+	if items, _ := m.Range("k", 0, -1); len(items) != 0 {
+		t.Fatal(items)
+	}
+}
+
+func TestQueueMemorySlowSubscriber(t *testing.T) {
+	m := QueueMemoryNew()
+	sub, _ := m.PSubscribe("q.*")
+	for i := 0; i <= QueueMemoryBuffer; i++ {
+		m.Publish("q.a", "x")
+	}
+	if m.Dropped() != 1 {
+		t.Fatal(m.Dropped())
+	}
+	n := 0
+	for range sub.Channel() {
+		n++
+	}
+	if n != QueueMemoryBuffer {
+		t.Fatal(n)
+	}
+}
+
+func queueNext(t *testing.T, events <-chan QueueEvent) QueueEvent {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(time.Second * 2):
+		t.Fatal("no event")
+	}
+	return QueueEvent{}
+}
+
+func TestQueueMemoryFollow(t *testing.T) {
+	q := QueueNewWithBackend(QueueMemoryNew(), 10)
+	q.ListenAll("*")
+	if q.State() != QueueConnected || q.HealthCheck() != nil {
+		t.Fatal("queue is not connected")
+	}
+	q.Push("chat", "message", 1, 0, 1, []byte("one"), true)
+	q.Push("chat", "message", 1, 0, 2, []byte("two"), true)
+	q.Push("other", "message", 1, 0, 3, []byte("skip"), true)
+
+	stop := make(chan bool)
+	events, drop := q.Follow([]string{"chat"}, 1, stop)
+	if drop {
+		t.Fatal("nothing is lost")
+	}
+	if event := queueNext(t, events); event.ID != 2 || string(event.Data) != "two" {
+		t.Fatal(event)
+	}
+	q.Push("chat", "typing", 1, 0, 4, []byte("live"), false)
+	event := queueNext(t, events)
+	if event.ID != 4 || event.Type != "typing" || event.Key != "q.chat" || string(event.Data) != "live" {
+		t.Fatal(event)
+	}
+	close(stop)
+	for range events {
+	}
+
+	history, drop, err := q.GetHistory("chat", 0)
+	if err != nil || drop || len(history) != 2 {
+		t.Fatal(history, drop, err)
+	}
+}
@@ -0,0 +1,174 @@
+package zero
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QueueEncodingVersion is a version of event envelope written by Queue, it is the first byte of encoded event.
+// Text events of older versions start with digit of event id, so both could be stored in the same history
+const QueueEncodingVersion = 1
+
+// ErrQueueEncoding is returned for events which could not be encoded in legacy text format or decoded
+var ErrQueueEncoding = errors.New("invalid queue event encoding")
+
+// QueueDataEncode encodes event as binary envelope, all fields including payload are length prefixed,
+// so type, headers and data could contain any bytes. Key is not encoded, it is the channel of the event
+func QueueDataEncode(event *QueueEvent) string {
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+len(event.Type)+len(event.Data)+16)
+	buf = append(buf, QueueEncodingVersion)
+	buf = queueAppendVarint(buf, event.ID)
+	buf = queueAppendVarint(buf, event.SessionID)
+	buf = queueAppendVarint(buf, event.UserID)
+	var timestamp int64
+	if !event.Time.IsZero() {
+		timestamp = event.Time.UnixNano()
+	}
+	buf = queueAppendVarint(buf, timestamp)
+	buf = queueAppendString(buf, event.Type)
+	names := make([]string, 0, len(event.Headers))
+	for name := range event.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf = queueAppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = queueAppendString(buf, name)
+		buf = queueAppendString(buf, event.Headers[name])
+	}
+	buf = queueAppendUvarint(buf, uint64(len(event.Data)))
+	buf = append(buf, event.Data...)
+	return string(buf)
+}
+
+func queueAppendVarint(buf []byte, v int64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutVarint(tmp[:], v)]...)
+}
+
+func queueAppendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func queueAppendString(buf []byte, s string) []byte {
+	buf = queueAppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// QueueDataEncodeLegacy encodes event in text format "id:session:user type payload" read by older versions,
+// headers are not sent, traceparent in ids would be read as user id by them. Type with spaces or new lines could not be encoded
+func QueueDataEncodeLegacy(event *QueueEvent) (string, error) {
+	if strings.ContainsAny(event.Type, " \r\n") {
+		return "", ErrQueueEncoding
+	}
+	var ids string
+	if event.SessionID == 0 && event.UserID == 0 {
+		ids = J(event.ID)
+	} else if event.UserID == 0 {
+		ids = J(event.ID, ":", event.SessionID)
+	} else {
+		ids = J(event.ID, ":", event.SessionID, ":", event.UserID)
+	}
+	return ids + " " + event.Type + " " + string(event.Data), nil
+}
+
+// queueDataDecode decodes binary envelope
+func queueDataDecode(data string) (*QueueEvent, error) {
+	d := queueDecoder{data: data}
+	if d.byte() != QueueEncodingVersion {
+		return nil, ErrQueueEncoding
+	}
+	event := &QueueEvent{
+		ID:        d.varint(),
+		SessionID: d.varint(),
+		UserID:    d.varint(),
+	}
+	if timestamp := d.varint(); timestamp != 0 {
+		event.Time = time.Unix(0, timestamp)
+	}
+	event.Type = d.string()
+	count := d.uvarint()
+	if count > uint64(len(d.data)) {
+		return nil, ErrQueueEncoding
+	}
+	if count > 0 {
+		event.Headers = make(map[string]string, count)
+		for i := uint64(0); i < count; i++ {
+			name := d.string()
+			event.Headers[name] = d.string()
+		}
+	}
+	event.Data = []byte(d.string())
+	if d.err != nil || len(d.data) != 0 {
+		return nil, ErrQueueEncoding
+	}
+	return event, nil
+}
+
+// queueDecoder reads envelope fields, first error is kept and makes next reads return zero values
+type queueDecoder struct {
+	data string
+	err  error
+}
+
+func (d *queueDecoder) byte() byte {
+	if d.err != nil || len(d.data) == 0 {
+		d.err = ErrQueueEncoding
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *queueDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint([]byte(d.data[:queueVarintLen(d.data)]))
+	if n <= 0 {
+		d.err = ErrQueueEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *queueDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint([]byte(d.data[:queueVarintLen(d.data)]))
+	if n <= 0 {
+		d.err = ErrQueueEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *queueDecoder) string() string {
+	size := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if size > uint64(len(d.data)) {
+		d.err = ErrQueueEncoding
+		return ""
+	}
+	s := d.data[:size]
+	d.data = d.data[size:]
+	return s
+}
+
+// queueVarintLen limits varint decoding to its maximal length, so the whole payload is not copied
+func queueVarintLen(data string) int {
+	if len(data) > binary.MaxVarintLen64 {
+		return binary.MaxVarintLen64
+	}
+	return len(data)
+}
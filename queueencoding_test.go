@@ -0,0 +1,116 @@
+package zero
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueDataEncodeRoundTrip(t *testing.T) {
+	cases := []struct {
+		name  string
+		event QueueEvent
+	}{
+		{"empty", QueueEvent{}},
+		{"ids", QueueEvent{ID: 1 << 62, SessionID: -5, UserID: 42, Type: "message", Data: []byte("hi")}},
+		{"time", QueueEvent{ID: 1, Time: time.Unix(100, 5), Type: "t"}},
+		{"headers", QueueEvent{ID: 2, Type: "t", Headers: map[string]string{"traceparent": "00-a-b-01", "lang": ""}}},
+		{"any bytes", QueueEvent{ID: 3, Type: "two words\n", Data: []byte("a b\x00\xff\n")}},
+		{"long data", QueueEvent{ID: 4, Type: "t", Data: []byte(strings.Repeat("x", 70000))}},
+	}
+	for _, c := range cases {
+		data := QueueDataEncode(&c.event)
+		if data[0] != QueueEncodingVersion {
+			t.Fatal(c.name, "version is not the first byte")
+		}
+		event, err := queueDataDecode(data)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if parsed := QueueDataParse(data); !reflect.DeepEqual(parsed, event) {
+			t.Fatalf("%s: parse differs from decode: %+v", c.name, parsed)
+		}
+		expected := c.event
+		if len(expected.Headers) == 0 {
+			expected.Headers = nil
+		}
+		if expected.Data == nil {
+			expected.Data = []byte{}
+		}
+		if !event.Time.Equal(expected.Time) {
+			t.Fatalf("%s: got time %v", c.name, event.Time)
+		}
+		event.Time, expected.Time = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(*event, expected) {
+			t.Fatalf("%s: got %+v, expected %+v", c.name, *event, expected)
+		}
+	}
+}
+
+func TestQueueDataDecodeInvalid(t *testing.T) {
+	valid := QueueDataEncode(&QueueEvent{ID: 300, SessionID: 2, UserID: 3, Type: "message", Headers: map[string]string{"a": "b"}, Data: []byte("payload")})
+	for n := 0; n < len(valid); n++ {
+		if _, err := queueDataDecode(valid[:n]); err != ErrQueueEncoding {
+			t.Fatalf("cut to %d bytes: got %v", n, err)
+		}
+	}
+	cases := []struct {
+		name string
+		data string
+	}{
+		{"version", "\x02" + valid[1:]},
+		{"trailing bytes", valid + "x"},
+		{"unterminated varint", "\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"},
+		{"headers longer than data", "\x01\x00\x00\x00\x00\x00\xff\xff\xff\xff\x0f"},
+		{"string longer than data", "\x01\x00\x00\x00\x00\x10abc"},
+	}
+	for _, c := range cases {
+		if _, err := queueDataDecode(c.data); err != ErrQueueEncoding {
+			t.Fatalf("%s: got %v", c.name, err)
+		}
+		if QueueDataParse(c.data) != nil {
+			t.Fatalf("%s: parsed", c.name)
+		}
+	}
+}
+
+func TestQueueDataParseLegacy(t *testing.T) {
+	cases := []struct {
+		data     string
+		expected *QueueEvent
+	}{
+		{"5 message hello world", &QueueEvent{ID: 5, Type: "message", Data: []byte("hello world")}},
+		{"5:7 message ", &QueueEvent{ID: 5, SessionID: 7, Type: "message", Data: []byte{}}},
+		{"5:7:9 typing {}", &QueueEvent{ID: 5, SessionID: 7, UserID: 9, Type: "typing", Data: []byte("{}")}},
+		{"5:7:9:00-a-b-01 typing {}", &QueueEvent{ID: 5, SessionID: 7, UserID: 9, Type: "typing", Data: []byte("{}"),
+			Headers: map[string]string{"traceparent": "00-a-b-01"}}},
+		{"5 message", nil},
+		{"", nil},
+	}
+	for _, c := range cases {
+		if event := QueueDataParse(c.data); !reflect.DeepEqual(event, c.expected) {
+			t.Fatalf("%q: got %+v, expected %+v", c.data, event, c.expected)
+		}
+	}
+}
+
+func TestQueueDataEncodeLegacy(t *testing.T) {
+	cases := []struct {
+		event    QueueEvent
+		expected string
+		err      error
+	}{
+		{QueueEvent{ID: 5, Type: "message", Data: []byte("a b")}, "5 message a b", nil},
+		{QueueEvent{ID: 5, SessionID: 7, Type: "message"}, "5:7 message ", nil},
+		{QueueEvent{ID: 5, SessionID: 7, UserID: 9, Type: "t", Headers: map[string]string{"traceparent": "00-a-b-01"}}, "5:7:9 t ", nil},
+		{QueueEvent{ID: 5, Type: "two words"}, "", ErrQueueEncoding},
+		{QueueEvent{ID: 5, Type: "line\n"}, "", ErrQueueEncoding},
+	}
+	for _, c := range cases {
+		data, err := QueueDataEncodeLegacy(&c.event)
+		if data != c.expected || err != c.err {
+			t.Fatalf("%+v: got %q %v", c.event, data, err)
+		}
+	}
+}
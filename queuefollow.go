@@ -0,0 +1,262 @@
+package zero
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QueueFollowBuffer is a number of log entries kept for every follower, slower follower is closed
+const QueueFollowBuffer = 1000
+
+// errQueueFollowerSlow is logged when follower is closed because it does not read events
+var errQueueFollowerSlow = errors.New("queue follower is too slow")
+
+// queueFollower receives log entries of followed keys from the shared reader
+type queueFollower struct {
+	cursors map[string]string  // the last entry passed to the follower by key
+	ch      chan QueueLogEntry // closed when follower does not keep up
+}
+
+// queueLogReader reads all keys followed on the node with single blocking read loop and passes entries to followers,
+// so followers do not hold backend connections
+type queueLogReader struct {
+	log       QueueLog
+	cursors   map[string]string // position of the reader by key
+	followers map[string]map[*queueFollower]bool
+	running   bool
+	mux       sync.Mutex
+}
+
+// queueLogReaderNew return nil if backend is not a log
+func queueLogReaderNew(backend QueueBackend) *queueLogReader {
+	log, ok := backend.(QueueLog)
+	if !ok {
+		return nil
+	}
+	return &queueLogReader{
+		log:       log,
+		cursors:   map[string]string{},
+		followers: map[string]map[*queueFollower]bool{},
+	}
+}
+
+// add registers follower and return entries stored between its cursors and the reader positions,
+// they should be passed before entries of the channel
+func (r *queueLogReader) add(f *queueFollower) ([]QueueLogEntry, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	var err error
+	missed := []QueueLogEntry{}
+	for key, cursor := range f.cursors {
+		if r.followers[key] == nil {
+			r.followers[key] = map[*queueFollower]bool{}
+		}
+		r.followers[key][f] = true
+		position, ok := r.cursors[key]
+		if !ok {
+			r.cursors[key] = cursor
+			continue
+		}
+		// the reader already passed entries after the follower cursor
+		for err == nil && r.log.CursorLess(f.cursors[key], position) {
+			var entries []QueueLogEntry
+			entries, err = r.log.Read(map[string]string{key: f.cursors[key]}, 100, -1)
+			done := len(entries) == 0
+			for _, entry := range entries {
+				if r.log.CursorLess(position, entry.ID) {
+					done = true // next entries come from the reader
+					break
+				}
+				f.cursors[key] = entry.ID
+				missed = append(missed, entry)
+			}
+			if done {
+				break
+			}
+		}
+		if r.log.CursorLess(f.cursors[key], position) {
+			f.cursors[key] = position
+		}
+	}
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	return missed, err
+}
+
+// remove unregisters follower, keys without followers are not read anymore
+func (r *queueLogReader) remove(f *queueFollower) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.removeLocked(f)
+}
+
+func (r *queueLogReader) removeLocked(f *queueFollower) {
+	for key := range f.cursors {
+		delete(r.followers[key], f)
+		if len(r.followers[key]) == 0 {
+			delete(r.followers, key)
+			delete(r.cursors, key)
+		}
+	}
+}
+
+// run reads followed keys until all followers are gone, failed reads are retried every second
+func (r *queueLogReader) run() {
+	for {
+		r.mux.Lock()
+		if len(r.cursors) == 0 {
+			r.running = false
+			r.mux.Unlock()
+			return
+		}
+		cursors := make(map[string]string, len(r.cursors))
+		for key, cursor := range r.cursors {
+			cursors[key] = cursor
+		}
+		r.mux.Unlock()
+		// short block lets keys added meanwhile be read soon
+		entries, err := r.log.Read(cursors, 100, time.Second)
+		if err != nil {
+			Err("[QUEUE] follow failed", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		r.dispatch(cursors, entries)
+	}
+}
+
+// dispatch passes entries to followers, entries of keys which were followed again during the read are skipped
+func (r *queueLogReader) dispatch(cursors map[string]string, entries []QueueLogEntry) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, entry := range entries {
+		if r.cursors[entry.Key] != cursors[entry.Key] {
+			continue
+		}
+		r.cursors[entry.Key] = entry.ID
+		cursors[entry.Key] = entry.ID
+		for f := range r.followers[entry.Key] {
+			if !r.log.CursorLess(f.cursors[entry.Key], entry.ID) {
+				continue // got it while it was added
+			}
+			f.cursors[entry.Key] = entry.ID
+			select {
+			case f.ch <- entry:
+			default:
+				Err("[QUEUE]", errQueueFollowerSlow, entry.Key)
+				r.removeLocked(f)
+				close(f.ch)
+			}
+		}
+	}
+}
+
+// followLog replays keys from the log and follows them with the shared reader, events pushed without saving
+// are merged from ListenAll subscription
+func (q *Queue) followLog(keys []string, lastEventID int64, stop <-chan bool) (<-chan QueueEvent, bool) {
+	log := q.reader.log
+	qc := q.Chan()
+	for _, key := range keys {
+		qc.Subsribe(key)
+	}
+	f := &queueFollower{cursors: map[string]string{}, ch: make(chan QueueLogEntry, QueueFollowBuffer)}
+	events := []*QueueEvent{}
+	drop := false
+	floors := map[string]int64{} // live events up to the position are already stored, they come late
+	for _, key := range keys {
+		fullKey := "q." + key
+		floors[fullKey] = lastEventID
+		if lastEventID != 0 {
+			entries, truncated, err := log.Since(fullKey, lastEventID, q.limit)
+			if err == nil {
+				drop = drop || truncated
+				f.cursors[fullKey] = log.EventCursor(lastEventID)
+				for _, entry := range entries {
+					f.cursors[fullKey] = entry.ID
+					if event := QueueDataParse(entry.Payload); event != nil {
+						event.Key = fullKey
+						events = append(events, event)
+					}
+				}
+				continue
+			}
+			Err("[QUEUE] history failed", key, err)
+			drop = true
+		}
+		last, _, err := log.Since(fullKey, 0, 1) // the last stored entry is the position
+		cursor := ""
+		if err == nil && len(last) == 1 {
+			cursor = last[0].ID
+			if event := QueueDataParse(last[0].Payload); event != nil {
+				floors[fullKey] = event.ID
+			}
+		} else if err == nil {
+			cursor, err = log.Cursor(fullKey)
+		}
+		if err != nil {
+			Err("[QUEUE] follow failed", key, err)
+			drop = true
+			cursor = log.EventCursor(NowNano())
+		}
+		f.cursors[fullKey] = cursor
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	missed, err := q.reader.add(f)
+	if err != nil {
+		Err("[QUEUE] follow failed", err)
+		drop = true
+	}
+	for _, entry := range missed {
+		if event := QueueDataParse(entry.Payload); event != nil {
+			event.Key = entry.Key
+			events = append(events, event)
+		}
+	}
+	out := make(chan QueueEvent)
+	go func() {
+		defer close(out)
+		defer qc.UnsubscribeAll()
+		defer q.reader.remove(f)
+		dedup := QueueDuplcateNew(1000) // saved events come from both the log and the subscription
+		for _, event := range events {
+			dedup.Check(event)
+			select {
+			case out <- *event:
+			case <-stop:
+				return
+			}
+		}
+		for {
+			var event *QueueEvent
+			select {
+			case entry, ok := <-f.ch:
+				if !ok {
+					return
+				}
+				event = QueueDataParse(entry.Payload)
+				if event != nil {
+					event.Key = entry.Key
+				}
+			case live := <-qc.Chan:
+				if live.ID > floors[live.Key] {
+					event = &live
+				}
+			case <-stop:
+				return
+			}
+			if event == nil || dedup.Check(event) {
+				continue
+			}
+			select {
+			case out <- *event:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out, drop
+}
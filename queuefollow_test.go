@@ -0,0 +1,199 @@
+package zero
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// queueTestLog is a log backend on top of memory backend, positions are numbers of entries
+type queueTestLog struct {
+	*QueueMemory
+	entries map[string][]QueueLogEntry
+	reads   int64 // number of blocking reads
+	mux     sync.Mutex
+}
+
+func queueTestLogNew() *queueTestLog {
+	return &queueTestLog{QueueMemory: QueueMemoryNew(), entries: map[string][]QueueLogEntry{}}
+}
+
+func (l *queueTestLog) AppendEvent(key string, eventID int64, payload string, maxLen int64) error {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	id := strconv.Itoa(len(l.entries[key]) + 1)
+	l.entries[key] = append(l.entries[key], QueueLogEntry{Key: key, ID: id, Payload: payload})
+	return nil
+}
+
+func (l *queueTestLog) Since(key string, eventID int64, count int64) ([]QueueLogEntry, bool, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	result := []QueueLogEntry{}
+	for _, entry := range l.entries[key] {
+		if event := QueueDataParse(entry.Payload); event != nil && event.ID > eventID {
+			result = append(result, entry)
+		}
+	}
+	if eventID == 0 && int64(len(result)) > count {
+		result = result[int64(len(result))-count:]
+	}
+	return result, false, nil
+}
+
+func (l *queueTestLog) Cursor(key string) (string, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return strconv.Itoa(len(l.entries[key])), nil
+}
+
+func (l *queueTestLog) EventCursor(eventID int64) string {
+	return "0"
+}
+
+func (l *queueTestLog) CursorLess(a, b string) bool {
+	x, _ := strconv.Atoi(a)
+	y, _ := strconv.Atoi(b)
+	return x < y
+}
+
+func (l *queueTestLog) Read(cursors map[string]string, count int64, block time.Duration) ([]QueueLogEntry, error) {
+	if block >= 0 {
+		atomic.AddInt64(&l.reads, 1)
+	}
+	deadline := time.Now().Add(block)
+	for {
+		result := []QueueLogEntry{}
+		l.mux.Lock()
+		for key, cursor := range cursors {
+			position, _ := strconv.Atoi(cursor)
+			for _, entry := range l.entries[key][position:] {
+				if int64(len(result)) < count {
+					result = append(result, entry)
+				}
+			}
+		}
+		l.mux.Unlock()
+		if len(result) > 0 || time.Now().After(deadline) {
+			return result, nil
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestQueueFollowLog(t *testing.T) {
+	log := queueTestLogNew()
+	q := QueueNewWithBackend(log, 10)
+	q.ListenAll("*")
+	q.Push("chat", "message", 1, 0, 1, []byte("one"), true)
+	q.Push("chat", "message", 1, 0, 2, []byte("two"), true)
+
+	stop := make(chan bool)
+	defer close(stop)
+	resumed, _ := q.Follow([]string{"chat"}, 1, stop)
+	if event := queueNext(t, resumed); event.ID != 2 || event.Key != "q.chat" {
+		t.Fatal(event)
+	}
+	fresh, _ := q.Follow([]string{"chat"}, 0, stop)
+
+	q.Push("chat", "message", 1, 0, 3, []byte("three"), true)
+	q.Push("chat", "typing", 1, 0, 4, nil, false)
+	for _, events := range []<-chan QueueEvent{resumed, fresh} {
+		if event := queueNext(t, events); event.ID != 3 {
+			t.Fatal(event)
+		}
+		if event := queueNext(t, events); event.ID != 4 || event.Type != "typing" {
+			t.Fatal(event)
+		}
+		select {
+		case event := <-events:
+			t.Fatal("duplicate", event)
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+}
+
+func TestQueueFollowSharedReader(t *testing.T) {
+	log := queueTestLogNew()
+	q := QueueNewWithBackend(log, 10)
+	stop := make(chan bool)
+	streams := []<-chan QueueEvent{}
+	for i := 0; i < 20; i++ {
+		events, _ := q.Follow([]string{"chat", J("user.", i)}, 0, stop)
+		streams = append(streams, events)
+	}
+	time.Sleep(time.Millisecond * 20)
+	q.Push("chat", "message", 1, 0, 1, nil, true)
+	for _, events := range streams {
+		if event := queueNext(t, events); event.ID != 1 {
+			t.Fatal(event)
+		}
+	}
+	if reads := atomic.LoadInt64(&log.reads); reads > 5 {
+		t.Fatal("followers read the log themselves", reads)
+	}
+	close(stop)
+	for _, events := range streams {
+		for range events {
+		}
+	}
+}
+
+func TestQueueFollowSlow(t *testing.T) {
+	q := QueueNewWithBackend(queueTestLogNew(), QueueFollowBuffer*2)
+	stop := make(chan bool)
+	defer close(stop)
+	events, _ := q.Follow([]string{"chat"}, 0, stop)
+	for i := 1; i <= QueueFollowBuffer+200; i++ {
+		q.Push("chat", "message", 1, 0, int64(i), nil, true)
+	}
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return // closed, client resumes from the last event
+			}
+		case <-timeout:
+			t.Fatal("slow follower is not closed")
+		}
+	}
+}
+
+func TestStreamSocketSlow(t *testing.T) {
+	q := QueueNewWithBackend(queueTestLogNew(), 10)
+	h := &HTTP{}
+	h.Handle("/stream", func(req *Request) {
+		req.StreamQueue(q, "chat")
+	})
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go fasthttp.Serve(ln, h.serveCtx)
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		return ln.Dial()
+	}}
+	conn, _, err := dialer.Dial("ws://localhost/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the shared reader closes follower which does not keep up
+	q.reader.mux.Lock()
+	for f := range q.reader.followers["q.chat"] {
+		q.reader.removeLocked(f)
+		close(f.ch)
+	}
+	q.reader.mux.Unlock()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	_, _, err = conn.ReadMessage()
+	if closeErr, ok := err.(*websocket.CloseError); !ok || closeErr.Code != SocketCloseGoingAway || closeErr.Text != "resume" {
+		t.Fatal("slow client is not asked to resume", err)
+	}
+}
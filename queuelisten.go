@@ -0,0 +1,209 @@
+package zero
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// QueueState is connection state of queue listeners
+type QueueState int32
+
+// Queue states
+const (
+	QueueDisconnected QueueState = iota
+	QueueConnected
+)
+
+func (s QueueState) String() string {
+	if s == QueueConnected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+var (
+	// ErrQueueDisconnected is passed to Queue.OnError when subscription is lost and returned by HealthCheck until it is restored
+	ErrQueueDisconnected = errors.New("queue listener is disconnected")
+	// ErrQueueGap is passed to Queue.OnError when events missed during disconnect are already trimmed from history
+	ErrQueueGap = errors.New("queue events are lost")
+)
+
+// queueRestored is an event delivered by backfill, it is skipped if it comes live after that
+type queueRestored struct {
+	key string
+	id  int64
+}
+
+// ListenAll starts listener of the pattern, it waits for the first subscription attempt and never gives up:
+// subscription is restored with growing delay after failures and events of keys with local subscribers
+// pushed meanwhile are delivered from history if Backfill is on
+func (q *Queue) ListenAll(pattern string) {
+	q.stateMux.Lock()
+	q.patterns[pattern] = false
+	q.stateMux.Unlock()
+	ready := make(chan bool)
+	go q.listen(pattern, ready)
+	<-ready
+}
+
+// State return QueueConnected if listeners of all patterns are subscribed
+func (q *Queue) State() QueueState {
+	q.stateMux.Lock()
+	defer q.stateMux.Unlock()
+	return q.state
+}
+
+func (q *Queue) listen(pattern string, ready chan bool) {
+	readyOnce := sync.Once{}
+	first := q.ReconnectDelay
+	if first <= 0 {
+		first = time.Millisecond * 100
+	}
+	delay := first
+	since := time.Now() // events pushed after it are backfilled for keys without delivered events
+	for {
+		sub, err := q.backend.PSubscribe("q." + pattern)
+		if err != nil {
+			q.error(fmt.Errorf("queue subscribe %s: %w", pattern, err))
+			readyOnce.Do(func() { close(ready) })
+			time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+			delay *= 2
+			if q.ReconnectMaxDelay > 0 && delay > q.ReconnectMaxDelay {
+				delay = q.ReconnectMaxDelay
+			}
+			continue
+		}
+		q.setConnected(pattern, true)
+		readyOnce.Do(func() { close(ready) })
+		delay = first
+		var restored map[queueRestored]bool
+		if q.Backfill {
+			restored = q.backfill(pattern, since)
+		}
+		q.receive(sub, restored)
+		sub.Close()
+		since = time.Now().Add(-time.Second) // producers clocks could be a bit behind
+		q.setConnected(pattern, false)
+		q.error(fmt.Errorf("%w: %s", ErrQueueDisconnected, pattern))
+	}
+}
+
+// receive delivers messages until subscription is closed
+func (q *Queue) receive(sub QueueSubscription, restored map[queueRestored]bool) {
+	restoredUntil := time.Now().Add(time.Minute)
+	for msg := range sub.Channel() {
+		if len(msg.Channel) < 3 {
+			continue
+		}
+		key := msg.Channel[2:]
+		q.channelsRWMux.RLock()
+		_, ok := q.channels[key]
+		q.channelsRWMux.RUnlock()
+		if !ok {
+			continue
+		}
+		event := QueueDataParse(msg.Payload)
+		if event == nil {
+			continue
+		}
+		if restored != nil && time.Now().After(restoredUntil) {
+			restored = nil
+		}
+		if restored[queueRestored{key, event.ID}] {
+			continue
+		}
+		q.deliver(key, event)
+	}
+}
+
+// backfill delivers events stored after the last delivered event of every key with subscribers,
+// keys which did not get any event yet get events pushed after since
+func (q *Queue) backfill(pattern string, since time.Time) map[queueRestored]bool {
+	restored := map[queueRestored]bool{}
+	keys := []string{}
+	q.channelsRWMux.RLock()
+	for key := range q.channels {
+		if queueGlobMatch(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	q.channelsRWMux.RUnlock()
+	for _, key := range keys {
+		q.lastMux.Lock()
+		lastID := q.lastIDs[key]
+		q.lastMux.Unlock()
+		events, drop, err := q.GetHistory(key, lastID)
+		if err != nil {
+			q.error(fmt.Errorf("queue backfill %s: %w", key, err))
+			continue
+		}
+		if drop && lastID != 0 {
+			q.error(fmt.Errorf("%w: %s", ErrQueueGap, key))
+		}
+		for _, event := range events {
+			if lastID == 0 && (event.Time.IsZero() || event.Time.Before(since)) {
+				continue
+			}
+			restored[queueRestored{key, event.ID}] = true
+			q.deliver(key, event)
+		}
+	}
+	return restored
+}
+
+// deliver passes event to subscribers of the key, all the channels should be nonblocking
+func (q *Queue) deliver(key string, event *QueueEvent) {
+	q.channelsRWMux.RLock()
+	defer q.channelsRWMux.RUnlock()
+	chArr, ok := q.channels[key]
+	if !ok {
+		return
+	}
+	event.Key = "q." + key
+	q.lastMux.Lock()
+	if event.ID > q.lastIDs[key] {
+		q.lastIDs[key] = event.ID
+	}
+	q.lastMux.Unlock()
+	for ch := range chArr {
+		select {
+		case ch <- *event:
+			if internalMetrics != nil {
+				internalMetrics.queueDelivered.Inc()
+			}
+		default:
+			if internalMetrics != nil {
+				internalMetrics.queueDropped.Inc()
+			}
+		}
+	}
+}
+
+// setConnected updates state of the pattern and calls OnState if state of the queue is changed
+func (q *Queue) setConnected(pattern string, connected bool) {
+	q.stateMux.Lock()
+	q.patterns[pattern] = connected
+	state := QueueConnected
+	for _, up := range q.patterns {
+		if !up {
+			state = QueueDisconnected
+		}
+	}
+	changed := state != q.state
+	q.state = state
+	q.stateMux.Unlock()
+	if changed && q.OnState != nil {
+		q.OnState(state)
+	}
+}
+
+func (q *Queue) error(err error) {
+	if q.OnError != nil {
+		q.OnError(err)
+		return
+	}
+	Err("[QUEUE]", err)
+}
@@ -0,0 +1,230 @@
+package zero
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// QueueLogEntry is an event stored in log backend
+type QueueLogEntry struct {
+	Key     string
+	ID      string // position in the log, used as cursor
+	Payload string
+}
+
+// QueueLog is implemented by backends which store history as ordered log with lookup by event id,
+// Queue uses it instead of Append/Range for history and Follow reads live events from the log without gaps
+type QueueLog interface {
+	// AppendEvent stores payload under event id keeping about maxLen last events
+	AppendEvent(key string, eventID int64, payload string, maxLen int64) error
+	// Since return up to count events stored after eventID, last count events if eventID is 0.
+	// truncated is true if some events after eventID were already trimmed
+	Since(key string, eventID int64, count int64) (entries []QueueLogEntry, truncated bool, err error)
+	// Cursor return position of the last stored event, to read only new events
+	Cursor(key string) (string, error)
+	// EventCursor return position to read events stored after eventID
+	EventCursor(eventID int64) string
+	// CursorLess return true if position a is before b
+	CursorLess(a, b string) bool
+	// Read waits up to block for events after cursors which map keys to positions, it does not wait if block is negative
+	Read(cursors map[string]string, count int64, block time.Duration) ([]QueueLogEntry, error)
+}
+
+// QueueStreams stores history in redis streams, events are found by id in O(log n)
+// and followers read the stream itself, so nothing is lost between replay and live events.
+// Live delivery to ListenAll still uses pub/sub. Followers of the node share one blocked redis connection
+type QueueStreams struct {
+	QueueRedis
+}
+
+// QueueStreamsNew creates redis streams backend
+func QueueStreamsNew(client *redis.Client) *QueueStreams {
+	return &QueueStreams{QueueRedis{redis: client}}
+}
+
+// queueStreamID maps event id to stream entry id, nanosecond ids from Queue.EventID become real millisecond timestamps
+func queueStreamID(eventID int64) string {
+	return strconv.FormatInt(eventID/1e6, 10) + "-" + strconv.FormatInt(eventID%1e6, 10)
+}
+
+// queueStreamNext return the smallest entry id after passed one, XRANGE with exclusive start needs redis 6.2
+func queueStreamNext(id string) string {
+	ms, seq := queueStreamSplit(id)
+	return strconv.FormatUint(ms, 10) + "-" + strconv.FormatUint(seq+1, 10)
+}
+
+// queueStreamLess compares entry ids
+func queueStreamLess(a, b string) bool {
+	aMs, aSeq := queueStreamSplit(a)
+	bMs, bSeq := queueStreamSplit(b)
+	return aMs < bMs || (aMs == bMs && aSeq < bSeq)
+}
+
+func queueStreamSplit(id string) (uint64, uint64) {
+	chunks := strings.SplitN(id, "-", 2)
+	if len(chunks) != 2 {
+		ms, _ := strconv.ParseUint(id, 10, 64)
+		return ms, 0
+	}
+	ms, _ := strconv.ParseUint(chunks[0], 10, 64)
+	seq, _ := strconv.ParseUint(chunks[1], 10, 64)
+	return ms, seq
+}
+
+func queueStreamEntries(key string, messages []redis.XMessage) []QueueLogEntry {
+	entries := make([]QueueLogEntry, 0, len(messages))
+	for _, msg := range messages {
+		payload, _ := msg.Values["d"].(string)
+		entries = append(entries, QueueLogEntry{Key: key, ID: msg.ID, Payload: payload})
+	}
+	return entries
+}
+
+// AppendEvent implements QueueLog, entry id is taken from event id unless it is not greater than the last one
+func (s *QueueStreams) AppendEvent(key string, eventID int64, payload string, maxLen int64) error {
+	args := &redis.XAddArgs{
+		Stream:       key,
+		MaxLenApprox: maxLen,
+		ID:           "*",
+		Values:       map[string]interface{}{"d": payload},
+	}
+	if eventID > 0 {
+		args.ID = queueStreamID(eventID)
+		err := s.redis.XAdd(args).Err()
+		if err == nil || !strings.Contains(err.Error(), "equal or smaller") {
+			return err
+		}
+		args.ID = "*" // ids of other nodes went ahead, keep order of arrival
+	}
+	return s.redis.XAdd(args).Err()
+}
+
+// Since implements QueueLog
+func (s *QueueStreams) Since(key string, eventID int64, count int64) ([]QueueLogEntry, bool, error) {
+	if eventID == 0 {
+		messages, err := s.redis.XRevRangeN(key, "+", "-", count).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+		return queueStreamEntries(key, messages), false, nil
+	}
+	start := queueStreamNext(queueStreamID(eventID))
+	messages, err := s.redis.XRangeN(key, start, "+", count).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	// like list history, events could be lost if the oldest one is newer than requested and the stream is full
+	first, err := s.redis.XRangeN(key, "-", "+", 1).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	truncated := false
+	if len(first) > 0 && queueStreamLess(start, first[0].ID) {
+		length, err := s.redis.XLen(key).Result()
+		if err != nil {
+			return nil, false, err
+		}
+		truncated = length >= count
+	}
+	return queueStreamEntries(key, messages), truncated, nil
+}
+
+// Cursor implements QueueLog
+func (s *QueueStreams) Cursor(key string) (string, error) {
+	messages, err := s.redis.XRevRangeN(key, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+// EventCursor implements QueueLog
+func (s *QueueStreams) EventCursor(eventID int64) string {
+	return queueStreamID(eventID)
+}
+
+// CursorLess implements QueueLog
+func (s *QueueStreams) CursorLess(a, b string) bool {
+	return queueStreamLess(a, b)
+}
+
+// Read implements QueueLog
+func (s *QueueStreams) Read(cursors map[string]string, count int64, block time.Duration) ([]QueueLogEntry, error) {
+	keys := make([]string, 0, len(cursors))
+	ids := make([]string, 0, len(cursors))
+	for key, id := range cursors {
+		keys = append(keys, key)
+		ids = append(ids, id)
+	}
+	streams, err := s.redis.XRead(&redis.XReadArgs{
+		Streams: append(keys, ids...),
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil // timeout
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []QueueLogEntry{}
+	for _, stream := range streams {
+		entries = append(entries, queueStreamEntries(stream.Stream, stream.Messages)...)
+	}
+	return entries, nil
+}
+
+// Append implements QueueBackend on the stream, Queue uses AppendEvent instead
+func (s *QueueStreams) Append(key, payload string) (int64, error) {
+	pipe := s.redis.TxPipeline()
+	pipe.XAdd(&redis.XAddArgs{Stream: key, ID: "*", Values: map[string]interface{}{"d": payload}})
+	length := pipe.XLen(key)
+	_, err := pipe.Exec()
+	return length.Val(), err
+}
+
+// Trim implements QueueBackend
+func (s *QueueStreams) Trim(key string, keep int64) error {
+	if keep < 0 {
+		keep = 0
+	}
+	return s.redis.XTrim(key, keep).Err()
+}
+
+// Range implements QueueBackend with list indexes over the stream
+func (s *QueueStreams) Range(key string, start, stop int64) ([]string, error) {
+	messages, err := s.redis.XRange(key, "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(messages))
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}, nil
+	}
+	result := make([]string, 0, stop-start+1)
+	for _, entry := range queueStreamEntries(key, messages[start:stop+1]) {
+		result = append(result, entry.Payload)
+	}
+	return result, nil
+}
@@ -0,0 +1,373 @@
+package zero
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	// RateLimitTokenBucket allows bursts up to limit and refills tokens evenly during window
+	RateLimitTokenBucket int = iota
+	// RateLimitSlidingWindow counts requests in the window sliding with current time
+	RateLimitSlidingWindow
+)
+
+const (
+	// RateLimitByIP limits requests by real ip of the client
+	RateLimitByIP = 1 << iota
+	// RateLimitByUser limits requests by ReferenceID, anonymous requests are limited by ip
+	RateLimitByUser
+	// RateLimitByAPIKey limits requests by api key id, requests without api key are limited by ip
+	RateLimitByAPIKey
+	// RateLimitByRoute limits requests to every route separately, clients are limited by ip unless other flags are set
+	RateLimitByRoute
+	// RateLimitGlobal makes one bucket shared by all clients, or by all clients of the route with RateLimitByRoute
+	RateLimitGlobal
+)
+
+// ErrRateLimitInvalid is returned for limits without positive limit and window, they would give NaN remaining and reset
+var ErrRateLimitInvalid = errors.New("rate limit requires positive limit and window of at least 1ms")
+
+func rateLimitValidate(limit int64, window time.Duration) error {
+	if limit <= 0 || window < time.Millisecond {
+		return ErrRateLimitInvalid
+	}
+	return nil
+}
+
+// RateLimitResult is an outcome of rate limit check
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int64
+	Remaining  int64
+	Reset      time.Duration // time till limit is fully restored
+	RetryAfter time.Duration // time till next request is allowed, set only if not allowed
+}
+
+// RateLimitBackend stores rate limit state
+type RateLimitBackend interface {
+	Take(key string, algorithm int, limit int64, window time.Duration) (RateLimitResult, error)
+}
+
+// RateLimiter is a middleware limiting requests rate
+type RateLimiter struct {
+	Name      string // prefix for the keys, allows to have several limiters with the same backend
+	Backend   RateLimitBackend
+	Algorithm int
+	Limit     int64
+	Window    time.Duration
+	By        int // combination of RateLimitBy* flags, RateLimitByIP if not set
+}
+
+// RateLimiterNew creates limiter, it panics if limit or window is not positive
+func RateLimiterNew(algorithm int, limit int64, window time.Duration) *RateLimiter {
+	if err := rateLimitValidate(limit, window); err != nil {
+		panic(err)
+	}
+	return &RateLimiter{Algorithm: algorithm, Limit: limit, Window: window}
+}
+
+// Middleware checks limit and responds with 429 if it is exceeded
+func (l *RateLimiter) Middleware(req *Request, next func()) {
+	backend := l.Backend
+	if backend == nil {
+		backend = req.http.rateLimitBackend()
+	}
+	name := l.Name
+	if name == "" {
+		name = "rl"
+	}
+	req.takeLimit(backend, l.Algorithm, name+":"+req.rateLimitKey(l.By), l.Limit, l.Window)
+	next()
+}
+
+// Limit checks imperative limit for an action of the client (user or ip if anonymous)
+// using sliding window and responds with 429 if it is exceeded
+func (req *Request) Limit(action string, limit int64, window time.Duration) {
+	req.takeLimit(req.http.rateLimitBackend(), RateLimitSlidingWindow, "act:"+action+":"+req.rateLimitKey(RateLimitByUser), limit, window)
+}
+
+func (req *Request) takeLimit(backend RateLimitBackend, algorithm int, key string, limit int64, window time.Duration) {
+	if err := rateLimitValidate(limit, window); err != nil {
+		panic(err) // misconfigured limiter should not silently allow everything
+	}
+	result, err := backend.Take(key, algorithm, limit, window)
+	if err != nil {
+		// limiter failure should not take the service down
+		Err("[RATELIMIT]", err)
+		return
+	}
+	req.SetHeader("RateLimit-Limit", strconv.FormatInt(result.Limit, 10))
+	req.SetHeader("RateLimit-Remaining", strconv.FormatInt(result.Remaining, 10))
+	req.SetHeader("RateLimit-Reset", strconv.FormatInt(durationSeconds(result.Reset), 10))
+	if !result.Allowed {
+		req.SetHeader("Retry-After", strconv.FormatInt(durationSeconds(result.RetryAfter), 10))
+		req.ErrFlood("rate_limit", "too many requests, retry later")
+	}
+}
+
+func (req *Request) rateLimitKey(by int) string {
+	if by == 0 {
+		by = RateLimitByIP
+	}
+	key := ""
+	if by&RateLimitByRoute != 0 {
+		if req.Route != nil {
+			key += req.Route.Method + req.Route.Path + ":"
+		} else {
+			key += req.Path + ":"
+		}
+	}
+	if by&RateLimitGlobal != 0 {
+		return key + "g:"
+	}
+	client := ""
+	if by&RateLimitByAPIKey != 0 && req.APIKey != nil {
+		client += "k" + req.APIKey.ID + ":"
+	}
+	if by&RateLimitByUser != 0 && req.ReferenceID != 0 {
+		client += "u" + strconv.FormatInt(req.ReferenceID, 10) + ":"
+	} else if by&RateLimitByIP != 0 || client == "" {
+		// clients without api key or user do not share one bucket
+		client += "i" + req.GetRealIP().String() + ":"
+	}
+	return key + client
+}
+
+func (h *HTTP) rateLimitBackend() RateLimitBackend {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	if h.RateLimit == nil {
+		h.RateLimit = RateLimitMemoryNew()
+	}
+	return h.RateLimit
+}
+
+// durationSeconds rounds duration up to seconds
+func durationSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// RateLimitMemory is an in-process rate limit backend
+type RateLimitMemory struct {
+	buckets      map[string]*rateLimitBucket
+	mux          sync.Mutex
+	lastCleaning time.Time
+}
+
+type rateLimitBucket struct {
+	tokens   float64   // token bucket state or count of the current window
+	previous float64   // count of the previous window
+	updated  time.Time // last refill or start of the current window
+	expires  time.Time
+}
+
+// RateLimitMemoryNew creates in-memory backend
+func RateLimitMemoryNew() *RateLimitMemory {
+	return &RateLimitMemory{
+		buckets:      map[string]*rateLimitBucket{},
+		lastCleaning: time.Now(),
+	}
+}
+
+// Take implements RateLimitBackend
+func (m *RateLimitMemory) Take(key string, algorithm int, limit int64, window time.Duration) (RateLimitResult, error) {
+	if err := rateLimitValidate(limit, window); err != nil {
+		return RateLimitResult{}, err
+	}
+	now := time.Now()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if now.Sub(m.lastCleaning) > time.Minute {
+		for k, b := range m.buckets {
+			if now.After(b.expires) {
+				delete(m.buckets, k)
+			}
+		}
+		m.lastCleaning = now
+	}
+	bucket, ok := m.buckets[key]
+	if algorithm == RateLimitTokenBucket {
+		if !ok {
+			bucket = &rateLimitBucket{tokens: float64(limit), updated: now}
+			m.buckets[key] = bucket
+		}
+		bucket.tokens = tokenBucketRefill(bucket.tokens, now.Sub(bucket.updated), limit, window)
+		bucket.updated = now
+		bucket.expires = now.Add(window)
+		allowed := bucket.tokens >= 1
+		if allowed {
+			bucket.tokens--
+		}
+		return tokenBucketResult(allowed, bucket.tokens, limit, window), nil
+	}
+
+	windowStart := now.Truncate(window)
+	if !ok {
+		bucket = &rateLimitBucket{updated: windowStart}
+		m.buckets[key] = bucket
+	}
+	if !bucket.updated.Equal(windowStart) {
+		if windowStart.Sub(bucket.updated) == window {
+			bucket.previous = bucket.tokens
+		} else {
+			bucket.previous = 0
+		}
+		bucket.tokens = 0
+		bucket.updated = windowStart
+	}
+	bucket.expires = windowStart.Add(window * 2)
+	elapsed := float64(now.Sub(windowStart)) / float64(window)
+	estimate := bucket.previous*(1-elapsed) + bucket.tokens
+	allowed := estimate+1 <= float64(limit)
+	if allowed {
+		bucket.tokens++
+		estimate++
+	}
+	return slidingWindowResult(allowed, estimate, bucket.previous, elapsed, limit, window), nil
+}
+
+func tokenBucketRefill(tokens float64, passed time.Duration, limit int64, window time.Duration) float64 {
+	tokens += float64(passed) * float64(limit) / float64(window)
+	if tokens > float64(limit) {
+		tokens = float64(limit)
+	}
+	return tokens
+}
+
+func tokenBucketResult(allowed bool, tokens float64, limit int64, window time.Duration) RateLimitResult {
+	perToken := float64(window) / float64(limit)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int64(tokens),
+		Reset:     time.Duration((float64(limit) - tokens) * perToken),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * perToken)
+	}
+	return result
+}
+
+func slidingWindowResult(allowed bool, estimate, previous, elapsed float64, limit int64, window time.Duration) RateLimitResult {
+	remaining := int64(float64(limit) - estimate)
+	if remaining < 0 {
+		remaining = 0
+	}
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     time.Duration((1 - elapsed) * float64(window)),
+	}
+	if !allowed {
+		// wait till weight of the previous window drops enough or current window ends
+		retry := result.Reset
+		if previous > 0 {
+			over := estimate + 1 - float64(limit)
+			if wait := time.Duration(over / previous * float64(window)); wait < retry {
+				retry = wait
+			}
+		}
+		result.RetryAfter = retry
+	}
+	return result
+}
+
+// RateLimitRedis is a rate limit backend shared between nodes using redis
+type RateLimitRedis struct {
+	redis  *redis.Client
+	prefix string
+}
+
+// RateLimitRedisNew creates redis backend
+func RateLimitRedisNew(client *redis.Client) *RateLimitRedis {
+	return &RateLimitRedis{
+		redis:  client,
+		prefix: "rl.",
+	}
+}
+
+var rateLimitTokenBucketScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local data = redis.call("HMGET", KEYS[1], "t", "ts")
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil then
+	tokens = limit
+	ts = now
+end
+tokens = math.min(limit, tokens + (now - ts) * limit / window)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "t", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], window)
+return {allowed, tostring(tokens)}
+`)
+
+var rateLimitSlidingWindowScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local elapsed = tonumber(ARGV[3])
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local previous = tonumber(redis.call("GET", KEYS[2]) or "0")
+local estimate = previous * (1 - elapsed) + current
+if estimate + 1 > limit then
+	return {0, tostring(estimate), tostring(previous)}
+end
+redis.call("INCR", KEYS[1])
+redis.call("PEXPIRE", KEYS[1], window * 2)
+return {1, tostring(estimate + 1), tostring(previous)}
+`)
+
+// Take implements RateLimitBackend
+func (r *RateLimitRedis) Take(key string, algorithm int, limit int64, window time.Duration) (RateLimitResult, error) {
+	if err := rateLimitValidate(limit, window); err != nil {
+		return RateLimitResult{}, err
+	}
+	now := time.Now()
+	windowMs := int64(window / time.Millisecond)
+	if algorithm == RateLimitTokenBucket {
+		res, err := rateLimitTokenBucketScript.Run(r.redis, []string{r.prefix + key}, limit, windowMs, now.UnixNano()/int64(time.Millisecond)).Result()
+		if err != nil {
+			return RateLimitResult{Allowed: true, Limit: limit}, err
+		}
+		values, _ := res.([]interface{})
+		if len(values) != 2 {
+			return RateLimitResult{Allowed: true, Limit: limit}, nil
+		}
+		allowed, _ := values[0].(int64)
+		tokens, _ := strconv.ParseFloat(J(values[1]), 64)
+		return tokenBucketResult(allowed == 1, tokens, limit, window), nil
+	}
+
+	windowStart := now.Truncate(window)
+	current := windowStart.UnixNano() / int64(window)
+	elapsed := float64(now.Sub(windowStart)) / float64(window)
+	keys := []string{
+		r.prefix + key + strconv.FormatInt(current, 10),
+		r.prefix + key + strconv.FormatInt(current-1, 10),
+	}
+	res, err := rateLimitSlidingWindowScript.Run(r.redis, keys, limit, windowMs, strconv.FormatFloat(elapsed, 'f', 6, 64)).Result()
+	if err != nil {
+		return RateLimitResult{Allowed: true, Limit: limit}, err
+	}
+	values, _ := res.([]interface{})
+	if len(values) != 3 {
+		return RateLimitResult{Allowed: true, Limit: limit}, nil
+	}
+	allowed, _ := values[0].(int64)
+	estimate, _ := strconv.ParseFloat(J(values[1]), 64)
+	previous, _ := strconv.ParseFloat(J(values[2]), 64)
+	return slidingWindowResult(allowed == 1, estimate, previous, elapsed, limit, window), nil
+}
@@ -0,0 +1,37 @@
+package zero
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, nil)
+	anonymous := &Request{Ctx: ctx, Path: "/feed", http: &HTTP{}}
+	user := &Request{Ctx: ctx, Path: "/feed", http: &HTTP{}, ReferenceID: 7, APIKey: &APIKey{ID: "key1"}}
+	cases := []struct {
+		req      *Request
+		by       int
+		expected string
+	}{
+		{anonymous, 0, "i10.0.0.1:"},
+		{anonymous, RateLimitByUser, "i10.0.0.1:"},
+		{anonymous, RateLimitByAPIKey, "i10.0.0.1:"},
+		{anonymous, RateLimitByRoute, "/feed:i10.0.0.1:"},
+		{anonymous, RateLimitByRoute | RateLimitGlobal, "/feed:g:"},
+		{anonymous, RateLimitGlobal, "g:"},
+		{user, RateLimitByUser, "u7:"},
+		{user, RateLimitByUser | RateLimitByIP, "u7:"},
+		{user, RateLimitByAPIKey, "kkey1:"},
+		{user, RateLimitByAPIKey | RateLimitByIP, "kkey1:i10.0.0.1:"},
+		{user, RateLimitByRoute | RateLimitByUser, "/feed:u7:"},
+	}
+	for _, c := range cases {
+		if key := c.req.rateLimitKey(c.by); key != c.expected {
+			t.Fatalf("by %d: got %q, expected %q", c.by, key, c.expected)
+		}
+	}
+}
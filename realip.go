@@ -0,0 +1,142 @@
+package zero
+
+import (
+	"net"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// IPResolver finds ip of the client behind trusted proxies
+type IPResolver struct {
+	trusted []*net.IPNet
+}
+
+// ipResolverDefault trusts only proxies on the same host, like local nginx
+var ipResolverDefault, _ = IPResolverNew("127.0.0.0/8", "::1/128")
+
+// IPResolverNew creates resolver which trusts proxy headers only from passed networks,
+// single ip without mask is also accepted
+func IPResolverNew(cidrs ...string) (*IPResolver, error) {
+	r := &IPResolver{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, network)
+	}
+	return r, nil
+}
+
+// IsTrusted return true if ip belongs to trusted proxies
+func (r *IPResolver) IsTrusted(ip net.IP) bool {
+	for _, network := range r.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve return ip of the client, headers are used only if connection came from trusted proxy.
+// Forwarded (RFC 7239) or X-Forwarded-For chain is walked right-to-left and the first untrusted address is returned
+func (r *IPResolver) Resolve(ctx *fasthttp.RequestCtx) net.IP {
+	remote := ctx.RemoteIP()
+	if !r.IsTrusted(remote) {
+		return remote
+	}
+	chain := forwardedChain(&ctx.Request.Header)
+	if len(chain) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(string(ctx.Request.Header.Peek("X-Real-IP")))); ip != nil {
+			return ip
+		}
+		return remote
+	}
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := chain[i]
+		if ip == nil {
+			// address is hidden or broken, nothing behind it can be trusted
+			break
+		}
+		client = ip
+		if !r.IsTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// forwardedChain return list of addresses from Forwarded header or X-Forwarded-For if first is absent,
+// all headers with the same name are concatenated, invalid addresses are returned as nil
+func forwardedChain(header *fasthttp.RequestHeader) []net.IP {
+	forwarded := []string{}
+	xForwardedFor := []string{}
+	header.VisitAll(func(key, value []byte) {
+		switch strings.ToLower(string(key)) {
+		case "forwarded":
+			forwarded = append(forwarded, string(value))
+		case "x-forwarded-for":
+			xForwardedFor = append(xForwardedFor, string(value))
+		}
+	})
+	chain := []net.IP{}
+	if len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			chain = append(chain, forwardedFor(element))
+		}
+		return chain
+	}
+	for _, value := range strings.Split(strings.Join(xForwardedFor, ","), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		chain = append(chain, net.ParseIP(value))
+	}
+	return chain
+}
+
+// forwardedFor parses for= parameter of one Forwarded element like
+// for=192.0.2.60;proto=http or for="[2001:db8:cafe::17]:4711"
+func forwardedFor(element string) net.IP {
+	for _, pair := range strings.Split(element, ";") {
+		key, value := SplitDoubleString(strings.TrimSpace(pair), "=")
+		if strings.ToLower(key) != "for" {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if strings.HasPrefix(value, "[") {
+			end := strings.Index(value, "]")
+			if end == -1 {
+				return nil
+			}
+			return net.ParseIP(value[1:end])
+		}
+		if strings.Count(value, ":") == 1 {
+			value, _ = SplitDoubleString(value, ":")
+		}
+		// "unknown" and obfuscated identifiers are not parsed as ip and return nil
+		return net.ParseIP(value)
+	}
+	return nil
+}
+
+// SetTrustedProxies configures networks of proxies allowed to pass client ip in headers,
+// they replace default loopback networks, call it without arguments to trust no proxies
+func (h *HTTP) SetTrustedProxies(cidrs ...string) error {
+	resolver, err := IPResolverNew(cidrs...)
+	if err != nil {
+		return err
+	}
+	h.IPResolver = resolver
+	return nil
+}
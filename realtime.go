@@ -4,28 +4,56 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis"
 )
 
 // Queue is manager for event listeners with hostory of events
 type Queue struct {
-	redis         *redis.Client
+	// LegacyEncoding makes Push write old text format which older nodes could read, headers are not sent.
+	// It is on by default during rolling upgrades, turn it off when all nodes read binary envelope
+	LegacyEncoding bool
+	// ReconnectDelay is the first delay before ListenAll subscribes again, it doubles up to ReconnectMaxDelay
+	ReconnectDelay    time.Duration
+	ReconnectMaxDelay time.Duration
+	// Backfill makes ListenAll deliver events stored in history while it was disconnected, on by default when history is used
+	Backfill bool
+	// OnState is called when listeners of all patterns get connected or any of them is disconnected
+	OnState func(state QueueState)
+	// OnError is called for subscription errors and lost history, they are logged if it is not set
+	OnError       func(err error)
+	backend       QueueBackend
 	limit         int64
 	channels      map[string]map[chan QueueEvent]bool
 	channelsRWMux sync.RWMutex
+	lastIDs       map[string]int64 // last delivered event of keys with subscribers, used for backfill
+	lastMux       sync.Mutex
+	patterns      map[string]bool // patterns of ListenAll with their connection state
+	state         QueueState
+	stateMux      sync.Mutex
+	reader        *queueLogReader // shared reader of followed keys on QueueLog backends
 }
 
 // QueueEvent is an event objects stored in the queue
 type QueueEvent struct {
-	ID        int64  `json:"id"`
-	Key       string `json:"-"`
-	Type      string `json:"event"`
-	UserID    int64  `json:"-"`
-	SessionID int64  `json:"-"`
-	Data      []byte `json:"data"`
+	ID        int64     `json:"id"`
+	Key       string    `json:"-"`
+	Type      string    `json:"event"`
+	UserID    int64     `json:"-"`
+	SessionID int64     `json:"-"`
+	Time      time.Time `json:"-"` // when event was pushed, zero for events of the old format
+	// Headers are metadata passed with the event, like traceparent of the producer span
+	Headers map[string]string `json:"-"`
+	Data    []byte            `json:"data"`
+}
+
+// TraceParent return W3C traceparent of the producer span, empty for untraced events
+func (e *QueueEvent) TraceParent() string {
+	return e.Headers["traceparent"]
 }
 
 // QueueChan is a struct to controll Queue channels
@@ -37,74 +65,57 @@ type QueueChan struct {
 
 // QueueNew is a constructor of queue, limit == 0 means no history used
 func QueueNew(redis *redis.Client, limit int64) *Queue {
+	return QueueNewWithBackend(QueueRedisNew(redis), limit)
+}
+
+// QueueNewWithBackend creates queue on any backend, like QueueMemoryNew() for single node and tests
+func QueueNewWithBackend(backend QueueBackend, limit int64) *Queue {
 	return &Queue{
-		redis:    redis,
-		limit:    limit,
-		channels: map[string]map[chan QueueEvent]bool{},
+		LegacyEncoding:    true,
+		ReconnectDelay:    time.Millisecond * 100,
+		ReconnectMaxDelay: time.Second * 30,
+		Backfill:          limit > 0,
+		backend:           backend,
+		limit:             limit,
+		channels:          map[string]map[chan QueueEvent]bool{},
+		lastIDs:           map[string]int64{},
+		patterns:          map[string]bool{},
+		reader:            queueLogReaderNew(backend),
 	}
 }
 
-// QueueDataParse parse
+// QueueDataParse decodes event pushed by the queue, both binary envelope and old text format are supported,
+// return nil for malformed data
 func QueueDataParse(dataRaw string) *QueueEvent {
+	if len(dataRaw) > 0 && dataRaw[0] == QueueEncodingVersion {
+		event, err := queueDataDecode(dataRaw)
+		if err != nil {
+			return nil
+		}
+		return event
+	}
 	chunks := strings.SplitN(dataRaw, " ", 3)
 	if len(chunks) != 3 {
 		return nil
 	}
-	eventID, sessionID, userID := SplitTrippleInt64(chunks[0], ":")
+	// ids are "id:session:user" with optional ":traceparent" of traced events
+	ids := strings.SplitN(chunks[0], ":", 4)
+	var headers map[string]string
+	if len(ids) == 4 {
+		headers = map[string]string{"traceparent": ids[3]}
+		ids = ids[:3]
+	}
+	eventID, sessionID, userID := SplitTrippleInt64(strings.Join(ids, ":"), ":")
 	return &QueueEvent{
 		ID:        eventID,
 		UserID:    userID,
 		SessionID: sessionID,
 		Type:      chunks[1],
 		Data:      []byte(chunks[2]),
+		Headers:   headers,
 	}
 }
 
-// ListenAll will start listen process
-func (q *Queue) ListenAll(pattern string) {
-	pubsub := q.redis.PSubscribe("q." + pattern)
-	_, err := pubsub.Receive()
-	if err != nil {
-		panic(err)
-	}
-	ch := pubsub.Channel()
-	go func() {
-		for {
-			//fmt.Println("wait new ev")
-			msg, ok := <-ch
-			//fmt.Println("ev is here")
-
-			if !ok {
-				Err("[REDIS], msg not ok")
-				break
-			}
-			//fmt.Println("event from redis", msg.Channel, msg)
-			if len(msg.Channel) < 3 {
-				break
-			}
-			key := msg.Channel[2:]
-			q.channelsRWMux.RLock()
-			chArr, ok := q.channels[key]
-			q.channelsRWMux.RUnlock()
-			if ok { // channel found
-				event := QueueDataParse(msg.Payload)
-				if event == nil {
-					continue
-				}
-				event.Key = msg.Channel
-				//fmt.Println(">>>>>", event)
-				for ch := range chArr {
-					select {
-					case ch <- *event: // all the channels should be nonblocking
-					default:
-					}
-				}
-				//fmt.Println("<<<<< PUSHED")
-			}
-		}
-	}()
-}
-
 // EventID will return new event ID for push method
 func (q *Queue) EventID() int64 {
 	return NowNano()
@@ -112,30 +123,77 @@ func (q *Queue) EventID() int64 {
 
 // Push event to local subscribers
 // - save param means the event will be stored in queue
+// - with LegacyEncoding, which is on by default, event type with spaces or new lines fails with ErrQueueEncoding
 func (q *Queue) Push(key string, eventType string, userID, sessionID, eventID int64, eventBytes []byte, save bool) error {
-	var eventData string
-	if sessionID == 0 && userID == 0 {
-		eventData = J(eventID)
-	} else {
-		if userID == 0 {
-			eventData = J(eventID, ":", sessionID)
-		} else {
-			eventData = J(eventID, ":", sessionID, ":", userID)
+	return q.PushEvent(QueueEvent{
+		ID:        eventID,
+		Key:       key,
+		Type:      eventType,
+		UserID:    userID,
+		SessionID: sessionID,
+		Data:      eventBytes,
+	}, save)
+}
+
+// PushTraced works like Push but records producer span as child of parent and passes its traceparent
+// with the event, so listeners could continue the trace with Tracer.Start(event.TraceParent(), ...).
+// Traced events need LegacyEncoding = false, old text format drops traceparent
+func (q *Queue) PushTraced(parent *Span, key string, eventType string, userID, sessionID, eventID int64, eventBytes []byte, save bool) (err error) {
+	span := parent.Child("queue.push "+key, SpanKindProducer)
+	span.SetAttr("messaging.system", "zero.queue").SetAttr("messaging.destination", key).SetAttr("messaging.event", eventType)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+	event := QueueEvent{
+		ID:        eventID,
+		Key:       key,
+		Type:      eventType,
+		UserID:    userID,
+		SessionID: sessionID,
+		Data:      eventBytes,
+	}
+	if traceParent := span.TraceParent(); traceParent != "" {
+		event.Headers = map[string]string{"traceparent": traceParent}
+	}
+	return q.PushEvent(event, save)
+}
+
+// PushEvent pushes event with headers to event.Key, time is set if it is empty
+func (q *Queue) PushEvent(event QueueEvent, save bool) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	var data string
+	if q.LegacyEncoding {
+		var err error
+		data, err = QueueDataEncodeLegacy(&event)
+		if err != nil {
+			return err
 		}
+	} else {
+		data = QueueDataEncode(&event)
 	}
-	data := eventData + " " + eventType + " " + string(eventBytes)
-	fullKey := "q." + key
-	if q.limit > 0 && save {
-		num, err := q.redis.RPush(fullKey, data).Result()
+	fullKey := "q." + event.Key
+	if log, ok := q.backend.(QueueLog); ok && q.limit > 0 && save {
+		err := log.AppendEvent(fullKey, event.ID, data, q.limit)
+		if err != nil {
+			fmt.Println("PUSHING HISTORY FAIL", err)
+		}
+	} else if q.limit > 0 && save {
+		num, err := q.backend.Append(fullKey, data)
 		if err != nil {
 			fmt.Println("PUSHING HISTORY FAIL", err)
 		}
 		if num > q.limit*2 {
-			q.redis.LTrim(fullKey, int64(-q.limit), -1)
+			q.backend.Trim(fullKey, q.limit)
 		}
 	}
 
-	return q.redis.Publish("q."+key, data).Err()
+	if internalMetrics != nil {
+		internalMetrics.queuePublished.Inc()
+	}
+	return q.backend.Publish(fullKey, data)
 }
 
 // GetHistory return list of events from lastEventID
@@ -145,9 +203,23 @@ func (q *Queue) GetHistory(key string, lastEventID int64) ([]*QueueEvent, bool,
 		return events, false, errors.New("this queue doesnt store any events")
 	}
 	fullKey := "q." + key
-	eventsStr, err := q.redis.LRange(fullKey, int64(-q.limit), -1).Result()
+	if log, ok := q.backend.(QueueLog); ok {
+		entries, truncated, err := log.Since(fullKey, lastEventID, q.limit)
+		if err != nil {
+			return events, false, err
+		}
+		for _, entry := range entries {
+			event := QueueDataParse(entry.Payload)
+			if event == nil {
+				continue
+			}
+			event.Key = key
+			events = append(events, event)
+		}
+		return events, truncated, nil
+	}
+	eventsStr, err := q.backend.Range(fullKey, -q.limit, -1)
 	//fmt.Println("FETCHING History", fullKey, "params", 0, int64(q.limit))
-	//eventsStr, err := q.redis.LRange(fullKey, 0, q.limit).Result()
 	if err != nil {
 		fmt.Println("redis scanslice error", err)
 		return events, false, err
@@ -172,6 +244,88 @@ func (q *Queue) GetHistory(key string, lastEventID int64) ([]*QueueEvent, bool,
 	return events, false, nil
 }
 
+// Follow return events of keys stored after lastEventID followed by live events until stop is closed, then channel is closed.
+// drop is true if some of the stored events are lost and client should reload its state.
+// On QueueLog backends like QueueStreams saved events are read from the log, so nothing is lost between replay and live events,
+// events pushed without saving come from ListenAll subscription. Follower which does not keep up is closed, it should resume from the last event.
+// Other backends replay GetHistory and subscribe the keys like Chan does, duplicates are filtered
+func (q *Queue) Follow(keys []string, lastEventID int64, stop <-chan bool) (<-chan QueueEvent, bool) {
+	if q.reader != nil && q.limit > 0 {
+		return q.followLog(keys, lastEventID, stop)
+	}
+	qc := q.Chan()
+	for _, key := range keys {
+		qc.Subsribe(key)
+	}
+	events, drop := q.history(keys, lastEventID)
+	out := make(chan QueueEvent)
+	go func() {
+		defer close(out)
+		defer qc.UnsubscribeAll()
+		dedup := QueueDuplcateNew(1000)
+		for _, event := range events {
+			dedup.Check(event)
+			select {
+			case out <- *event:
+			case <-stop:
+				return
+			}
+		}
+		for {
+			select {
+			case event := <-qc.Chan:
+				if event.ID <= lastEventID || dedup.Check(&event) { // published before the position but delivered late
+					continue
+				}
+				select {
+				case out <- event:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return out, drop
+}
+
+// history return events of all keys after lastEventID ordered by id, drop is true if some of them are lost
+func (q *Queue) history(keys []string, lastEventID int64) ([]*QueueEvent, bool) {
+	events := []*QueueEvent{}
+	if lastEventID == 0 || q.limit == 0 {
+		return events, false
+	}
+	drop := false
+	for _, key := range keys {
+		keyEvents, keyDrop, err := q.GetHistory(key, lastEventID)
+		if err != nil {
+			Err("[QUEUE] history failed", key, err)
+			drop = true
+			continue
+		}
+		drop = drop || keyDrop
+		events = append(events, keyEvents...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, drop
+}
+
+// HealthCheck pings backend of the queue and checks ListenAll is subscribed, use it with Health.AddCheck
+func (q *Queue) HealthCheck() error {
+	err := q.backend.Ping()
+	if err != nil {
+		return err
+	}
+	q.stateMux.Lock()
+	listening := len(q.patterns) > 0
+	q.stateMux.Unlock()
+	if listening && q.State() != QueueConnected {
+		return ErrQueueDisconnected
+	}
+	return nil
+}
+
 // Chan will return QueueChan object to controll channel
 func (q *Queue) Chan() QueueChan {
 	ch := make(chan QueueEvent, 1000)
@@ -222,6 +376,9 @@ func (qc *QueueChan) Unsubscribe(key string) {
 		}
 		if cnt == 0 {
 			delete(q.channels, key)
+			q.lastMux.Lock()
+			delete(q.lastIDs, key)
+			q.lastMux.Unlock()
 		}
 	}
 	delete(qc.keys, key)
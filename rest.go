@@ -4,8 +4,9 @@ import "strings"
 
 // RestAPI is general object used for REST api
 type RestAPI struct {
-	Path string
-	http *HTTP
+	Path        string
+	http        *HTTP
+	middlewares []Middleware
 }
 
 func (r *RestAPI) joinPath(path string) []string {
@@ -17,34 +18,46 @@ func (r *RestAPI) joinPath(path string) []string {
 	return mainParts
 }
 
+func (r *RestAPI) push(method string, path string, callback func(req *Request)) *Route {
+	parts := r.joinPath(path)
+	route := &Route{
+		Method: method,
+		Path:   routePath(parts),
+		Group:  r,
+		Handle: callback,
+	}
+	r.http.handlers.PushHandler(Methods[method], parts, callback, []string{}, route)
+	return route
+}
+
 // GET handler for GET method
-func (r *RestAPI) GET(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["GET"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) GET(path string, callback func(req *Request)) *Route {
+	return r.push("GET", path, callback)
 }
 
 // POST handler for POST method
-func (r *RestAPI) POST(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["POST"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) POST(path string, callback func(req *Request)) *Route {
+	return r.push("POST", path, callback)
 }
 
 // PATCH handler for PATCH method
-func (r *RestAPI) PATCH(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["PATCH"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) PATCH(path string, callback func(req *Request)) *Route {
+	return r.push("PATCH", path, callback)
 }
 
 // PUT handler for PUT method
-func (r *RestAPI) PUT(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["PUT"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) PUT(path string, callback func(req *Request)) *Route {
+	return r.push("PUT", path, callback)
 }
 
 // DELETE handler for DELETE method
-func (r *RestAPI) DELETE(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["DELETE"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) DELETE(path string, callback func(req *Request)) *Route {
+	return r.push("DELETE", path, callback)
 }
 
 // UPDATE handler for UPDATE method
-func (r *RestAPI) UPDATE(path string, callback func(req *Request)) {
-	r.http.handlers.PushHandler(Methods["UPDATE"], r.joinPath(path), callback, []string{})
+func (r *RestAPI) UPDATE(path string, callback func(req *Request)) *Route {
+	return r.push("UPDATE", path, callback)
 }
 
 // SetCORS setup cors header for the api
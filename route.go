@@ -0,0 +1,178 @@
+package zero
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Route describes registered handler with permissions required to access it
+type Route struct {
+	Method      string             `json:"method"`
+	Path        string             `json:"path"`
+	Roles       []string           `json:"roles,omitempty"`  // principal should have one of these roles
+	Scopes      []string           `json:"scopes,omitempty"` // principal should have all of these scopes
+	Description string             `json:"description,omitempty"`
+	Group       *RestAPI           `json:"-"`
+	Handle      func(req *Request) `json:"-"`
+	bare        bool               // middlewares are not run, probes should answer even when limits or auth reject clients
+}
+
+// Principal is an authenticated subject with its permissions
+type Principal struct {
+	ID     int64
+	Roles  []string
+	Scopes []string
+}
+
+// Authorizer resolves principal by ReferenceID of the request
+type Authorizer interface {
+	Principal(referenceID int64) (*Principal, error)
+}
+
+// AuthorizerFunc allows to use ordinary function as Authorizer
+type AuthorizerFunc func(referenceID int64) (*Principal, error)
+
+// Principal calls f(referenceID)
+func (f AuthorizerFunc) Principal(referenceID int64) (*Principal, error) {
+	return f(referenceID)
+}
+
+// HasRole checks if principal has role
+func (p *Principal) HasRole(role string) bool {
+	return OneOf(role, p.Roles...)
+}
+
+// HasScope checks if principal has scope, "*" scope allows everything
+func (p *Principal) HasScope(scope string) bool {
+	return OneOf(scope, p.Scopes...) || OneOf("*", p.Scopes...)
+}
+
+// Require sets roles, one of which principal should have to access the route
+func (r *Route) Require(roles ...string) *Route {
+	r.Roles = append(r.Roles, roles...)
+	return r
+}
+
+// RequireScope sets scopes principal should have to access the route
+func (r *Route) RequireScope(scopes ...string) *Route {
+	r.Scopes = append(r.Scopes, scopes...)
+	return r
+}
+
+// Describe sets description shown in route introspection
+func (r *Route) Describe(description string) *Route {
+	r.Description = description
+	return r
+}
+
+// IsProtected return true if route requires any permissions
+func (r *Route) IsProtected() bool {
+	return len(r.Roles) > 0 || len(r.Scopes) > 0
+}
+
+// checkRoutes panics if routes require roles which could not be resolved, it is called when server starts
+func (h *HTTP) checkRoutes() {
+	if h.Authorizer != nil {
+		return
+	}
+	for _, route := range h.Routes() {
+		if len(route.Roles) > 0 {
+			panic("route " + route.Method + " " + route.Path + " requires roles but HTTP.Authorizer is not set")
+		}
+	}
+}
+
+// routePath joins path parts into normalized route path
+func routePath(parts []string) string {
+	clean := []string{}
+	for _, part := range parts {
+		if part != "" {
+			clean = append(clean, part)
+		}
+	}
+	return "/" + strings.Join(clean, "/")
+}
+
+// Routes return list of all registered routes sorted by path
+func (h *HTTP) Routes() []*Route {
+	routes := h.handlers.routes([]*Route{})
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path == routes[j].Path {
+			return routes[i].Method < routes[j].Method
+		}
+		return routes[i].Path < routes[j].Path
+	})
+	return routes
+}
+
+// Principal return authorized principal of the request, resolved with HTTP.Authorizer
+func (req *Request) Principal() (*Principal, error) {
+	if req.principal != nil {
+		return req.principal, nil
+	}
+	if req.ReferenceID == 0 && req.APIKey == nil {
+		return nil, errors.New("request is not authenticated")
+	}
+	principal := &Principal{ID: req.ReferenceID}
+	if req.http.Authorizer != nil && req.ReferenceID != 0 {
+		resolved, err := req.http.Authorizer.Principal(req.ReferenceID)
+		if err != nil {
+			return nil, err
+		}
+		if resolved != nil {
+			// authorizer could return cached principal, it is copied so api key scopes do not leak to other requests
+			copied := *resolved
+			copied.Roles = append([]string{}, resolved.Roles...)
+			copied.Scopes = append([]string{}, resolved.Scopes...)
+			principal = &copied
+		}
+	}
+	if req.APIKey != nil {
+		// api key can only narrow permissions of its owner
+		if req.ReferenceID == 0 || req.http.Authorizer == nil {
+			principal.Scopes = append([]string{}, req.APIKey.Scopes...)
+		} else {
+			scopes := []string{}
+			for _, scope := range req.APIKey.Scopes {
+				if principal.HasScope(scope) {
+					scopes = append(scopes, scope)
+				}
+			}
+			principal.Scopes = scopes
+		}
+	}
+	req.principal = principal
+	return principal, nil
+}
+
+// authorize checks request principal against permissions required by route
+func (req *Request) authorize(route *Route) {
+	if req.ReferenceID == 0 && req.APIKey == nil {
+		req.ErrAuth("auth_required", "authentication required")
+	}
+	principal, err := req.Principal()
+	if err != nil {
+		req.ErrServer("authorizer", err)
+	}
+	if len(route.Roles) > 0 {
+		if req.http.Authorizer == nil {
+			req.ErrServer("authorizer", "route requires roles but HTTP.Authorizer is not set")
+		}
+		allowed := false
+		for _, role := range route.Roles {
+			if principal.HasRole(role) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			req.ErrForbidden("role_required", "one of roles required: "+strings.Join(route.Roles, ", "))
+		}
+	}
+	for _, scope := range route.Scopes {
+		if !principal.HasScope(scope) {
+			req.ErrForbidden("scope_required", "scope required: "+scope)
+		}
+	}
+}
@@ -27,13 +27,15 @@ type routerTree struct {
 type routerMethodHandler struct {
 	Keys   []string
 	Handle func(req *Request)
+	Route  *Route
 }
 
-func (p *routerTree) PushHandler(method int, parts []string, handler func(req *Request), keys []string) {
+func (p *routerTree) PushHandler(method int, parts []string, handler func(req *Request), keys []string, route *Route) {
 	if len(parts) == 0 {
 		methodHandler := routerMethodHandler{
 			Keys:   keys,
 			Handle: handler,
+			Route:  route,
 		}
 		if p.Methods == nil {
 			p.Methods = map[int]routerMethodHandler{}
@@ -43,7 +45,7 @@ func (p *routerTree) PushHandler(method int, parts []string, handler func(req *R
 	}
 	row := parts[0]
 	if row == "" {
-		p.PushHandler(method, parts[1:], handler, keys)
+		p.PushHandler(method, parts[1:], handler, keys, route)
 		return
 	}
 	if row[0:1] == ":" {
@@ -59,26 +61,26 @@ func (p *routerTree) PushHandler(method int, parts []string, handler func(req *R
 		branch = &routerTree{}
 		p.Tree[row] = branch
 	}
-	branch.PushHandler(method, parts[1:], handler, keys)
+	branch.PushHandler(method, parts[1:], handler, keys, route)
 }
 
-func (p *routerTree) getHandler(method int, parts []string, values []string) (func(req *Request), []string, []string, error) {
+func (p *routerTree) getHandler(method int, parts []string, values []string) (*routerMethodHandler, []string, error) {
 	if len(parts) == 0 {
 		if p.Methods == nil {
-			return nil, nil, nil, errors.New("This path is not supported (methods are nil)")
+			return nil, nil, errors.New("This path is not supported (methods are nil)")
 		}
 		if method == Methods["*"] {
 			for _, m := range p.Methods {
-				return m.Handle, m.Keys, values, nil
+				return &m, values, nil
 			}
 		} else {
 			m, ok := p.Methods[method]
 			if ok {
-				return m.Handle, m.Keys, values, nil
+				return &m, values, nil
 			} else {
 				m, ok := p.Methods[Methods["*"]]
 				if ok {
-					return m.Handle, m.Keys, values, nil
+					return &m, values, nil
 				}
 			}
 		}
@@ -95,7 +97,7 @@ func (p *routerTree) getHandler(method int, parts []string, values []string) (fu
 			}
 		}
 		errorText := thisMethod + " method is not supported for this path, use " + strings.Join(supported, " or ")
-		return nil, nil, nil, errors.New(errorText)
+		return nil, nil, errors.New(errorText)
 	}
 	row := parts[0]
 	if row == "" {
@@ -113,28 +115,44 @@ func (p *routerTree) getHandler(method int, parts []string, values []string) (fu
 		values = append(values, row)
 		return branch.getHandler(method, parts[1:], values)
 	}
-	return nil, nil, nil, errors.New("This path is not supported (" + strings.Join(parts, "/") + ")")
+	return nil, nil, errors.New("This path is not supported (" + strings.Join(parts, "/") + ")")
 }
 
 // public methods here
 
-func (p *routerTree) Handle(method int, path string, handler func(req *Request)) {
+func (p *routerTree) Handle(method int, path string, handler func(req *Request), route *Route) {
 	parts := strings.Split(path, "/")
-	p.PushHandler(method, parts, handler, []string{})
+	p.PushHandler(method, parts, handler, []string{}, route)
 }
 
-func (p *routerTree) Route(method int, path string) (func(req *Request), map[string]string, error) {
+// routes collects all routes registered in the tree
+func (p *routerTree) routes(result []*Route) []*Route {
+	for _, m := range p.Methods {
+		if m.Route != nil {
+			result = append(result, m.Route)
+		}
+	}
+	for _, branch := range p.Tree {
+		result = branch.routes(result)
+	}
+	return result
+}
+
+func (p *routerTree) Route(method int, path string) (*routerMethodHandler, map[string]string, error) {
 	parts := strings.Split(path, "/")
-	cb, keys, values, err := p.getHandler(method, parts, []string{})
+	handler, values, err := p.getHandler(method, parts, []string{})
 	if err != nil {
 		fmt.Println("PATH ERROR", err)
 		fmt.Println("PATH ERROR", method, "path:", path)
 	}
 	params := map[string]string{}
-	for n, key := range keys {
+	if handler == nil {
+		return nil, params, err
+	}
+	for n, key := range handler.Keys {
 		if len(values) > n {
 			params[key] = values[n]
 		}
 	}
-	return cb, params, err
+	return handler, params, err
 }
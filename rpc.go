@@ -0,0 +1,487 @@
+package zero
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	RPCParseError     = -32700
+	RPCInvalidRequest = -32600
+	RPCMethodNotFound = -32601
+	RPCInvalidParams  = -32602
+	RPCInternalError  = -32603
+)
+
+// ErrRPCTimeout is returned when client does not answer server call in time
+var ErrRPCTimeout = errors.New("rpc call timeout")
+
+// RPCError is an error object of JSON-RPC response
+type RPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e *RPCError) Error() string {
+	return "rpc error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// RPCErrorCode maps http status of zero errors to JSON-RPC code, 4xx are -32000 - (status - 400)
+// so 401 is -32001 and 429 is -32029, 5xx are internal errors
+func RPCErrorCode(httpCode int) int {
+	if httpCode >= 400 && httpCode < 500 {
+		return -32000 - (httpCode - 400)
+	}
+	return RPCInternalError
+}
+
+// RPCHandler serves a method, result is encoded as json, errors abort handling with call.Err* like in http handlers
+type RPCHandler func(call *RPCCall) interface{}
+
+// RPCCall is a single method call
+type RPCCall struct {
+	Method string
+	Params json.RawMessage
+	// Req is a copy of the http request or the request upgraded to websocket with own Ctx,
+	// so req.Err* and middlewares could be used in handlers, their errors are returned to the client
+	Req *Request
+	// Conn is set for calls received over websocket, it could be used to call client methods
+	Conn *RPCConn
+}
+
+// Bind decodes params into v, aborts with invalid params error if they do not match
+func (call *RPCCall) Bind(v interface{}) {
+	err := json.Unmarshal(call.Params, v)
+	if err != nil {
+		panic(&RPCError{Code: RPCInvalidParams, Message: err.Error()})
+	}
+}
+
+// ErrCode aborts the call with error of http status, code and text are passed in error data
+func (call *RPCCall) ErrCode(httpCode int, code string, text interface{}) {
+	desc := fmt.Sprintf("%s", text)
+	panic(&RPCError{
+		Code:    RPCErrorCode(httpCode),
+		Message: desc,
+		Data:    H{"code": code, "desc": desc, "status": httpCode},
+	})
+}
+
+// Err aborts the call with bad request error
+func (call *RPCCall) Err(code string, text interface{}) {
+	call.ErrCode(400, code, text)
+}
+
+// ErrAuth aborts the call with auth error
+func (call *RPCCall) ErrAuth(code string, text interface{}) {
+	call.ErrCode(401, code, text)
+}
+
+// ErrForbidden aborts the call with forbidden error
+func (call *RPCCall) ErrForbidden(code string, text interface{}) {
+	call.ErrCode(403, code, text)
+}
+
+// ErrNotFound aborts the call with not found error
+func (call *RPCCall) ErrNotFound(code string, text interface{}) {
+	call.ErrCode(404, code, text)
+}
+
+// ErrFlood aborts the call with too many requests error
+func (call *RPCCall) ErrFlood(code string, text interface{}) {
+	call.ErrCode(429, code, text)
+}
+
+// ErrServer aborts the call with internal error
+func (call *RPCCall) ErrServer(code string, text interface{}) {
+	call.ErrCode(500, code, text)
+}
+
+// rpcMessage is a request, notification or response
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPC is a JSON-RPC 2.0 dispatcher, methods are registered once and served over http and websocket
+type RPC struct {
+	// OnPanic is called for unexpected panics of handlers, client gets internal error
+	OnPanic func(call *RPCCall, stackTrace string)
+	// BatchConcurrency is a number of calls of one batch served in parallel, 8 by default
+	BatchConcurrency int
+	// MaxPending is a number of messages of one websocket connection served in parallel, 64 by default,
+	// calls of messages above the limit get internal error
+	MaxPending int
+	methods    map[string]RPCHandler
+	mux        sync.RWMutex
+}
+
+// RPCNew creates dispatcher
+func RPCNew() *RPC {
+	return &RPC{methods: map[string]RPCHandler{}, BatchConcurrency: 8, MaxPending: 64}
+}
+
+// rpcSource is a copy of the http request, every call gets own context made from it
+type rpcSource struct {
+	req        Request
+	http       fasthttp.Request
+	remoteAddr net.Addr
+}
+
+func rpcSourceNew(req *Request) *rpcSource {
+	src := &rpcSource{req: *req, remoteAddr: req.Ctx.RemoteAddr()}
+	req.Ctx.Request.CopyTo(&src.http)
+	return src
+}
+
+// request return copy of the request with own Ctx, response written by the handler is not sent
+func (src *rpcSource) request() *Request {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&src.http, src.remoteAddr, nil)
+	req := src.req
+	req.Ctx = ctx
+	req.supportGZip = false
+	req.OnResponse = nil
+	req.OnFail = nil
+	return &req
+}
+
+// Register adds method
+func (r *RPC) Register(method string, handler RPCHandler) {
+	r.mux.Lock()
+	r.methods[method] = handler
+	r.mux.Unlock()
+}
+
+// Handle serves JSON-RPC over http POST, use it as route handler
+func (r *RPC) Handle(req *Request) {
+	if !req.Ctx.IsPost() {
+		req.ErrMethod("method_not_allowed", "json-rpc requires POST")
+	}
+	responses, ok := r.dispatch(req.GetBody(), rpcSourceNew(req), nil)
+	if responses == nil {
+		req.Ctx.SetStatusCode(204) // only notifications
+		return
+	}
+	if ok {
+		req.Resp(responses)
+	} else {
+		req.Resp(responses.([]*rpcResponse)[0])
+	}
+}
+
+// Serve upgrades request to websocket and serves JSON-RPC over it, returned connection could call client methods
+func (r *RPC) Serve(req *Request) *RPCConn {
+	src := rpcSourceNew(req) // req.Ctx is reused by fasthttp after upgrade
+	conn := &RPCConn{
+		Socket:  req.UpgradeWS(nil),
+		Timeout: time.Second * 30,
+		pending: map[string]chan *rpcMessage{},
+	}
+	maxPending := r.MaxPending
+	if maxPending <= 0 {
+		maxPending = 1
+	}
+	pending := make(chan bool, maxPending)
+	conn.Socket.OnMessage = func(soc *Socket, data []byte) {
+		raw := json.RawMessage{}
+		err := soc.Decode(data, &raw)
+		if err != nil {
+			raw = data // malformed data, dispatch answers with parse error
+		}
+		if conn.response(raw) {
+			return
+		}
+		select {
+		case pending <- true:
+		default:
+			// reader should not block, client answers to server calls come through it
+			if responses, batch := rpcRejected(raw); batch {
+				soc.SendValue(responses)
+			} else if len(responses) == 1 {
+				soc.SendValue(responses[0])
+			}
+			return
+		}
+		go func() { // calls are served in parallel, so they could wait for client answers
+			defer func() { <-pending }()
+			responses, batch := r.dispatch(raw, src, conn)
+			if responses == nil {
+				return
+			}
+			if batch {
+				soc.SendValue(responses)
+			} else {
+				soc.SendValue(responses.([]*rpcResponse)[0])
+			}
+		}()
+	}
+	conn.Socket.OnClose = func(soc *Socket, code int, reason string) {
+		conn.closePending()
+	}
+	return conn
+}
+
+// dispatch runs single call or batch, return nil if there is nothing to answer
+// and true if the responses should be sent as array
+func (r *RPC) dispatch(data []byte, src *rpcSource, conn *RPCConn) (interface{}, bool) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		batch := []json.RawMessage{}
+		err := json.Unmarshal(data, &batch)
+		if err != nil {
+			return []*rpcResponse{rpcErrorResponse(nil, RPCParseError, err.Error())}, false
+		}
+		if len(batch) == 0 {
+			return []*rpcResponse{rpcErrorResponse(nil, RPCInvalidRequest, "empty batch")}, false
+		}
+		responses := make([]*rpcResponse, len(batch))
+		concurrency := r.BatchConcurrency
+		if concurrency <= 0 {
+			concurrency = 1
+		}
+		sem := make(chan bool, concurrency)
+		wg := sync.WaitGroup{}
+		for i, item := range batch {
+			wg.Add(1)
+			sem <- true
+			go func(i int, item json.RawMessage) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				responses[i] = r.call(item, src, conn)
+			}(i, item)
+		}
+		wg.Wait()
+		result := []*rpcResponse{}
+		for _, resp := range responses {
+			if resp != nil {
+				result = append(result, resp)
+			}
+		}
+		if len(result) == 0 {
+			return nil, true
+		}
+		return result, true
+	}
+	msg := rpcMessage{}
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		return []*rpcResponse{rpcErrorResponse(nil, RPCParseError, err.Error())}, false
+	}
+	resp := r.call(data, src, conn)
+	if resp == nil {
+		return nil, false
+	}
+	return []*rpcResponse{resp}, false
+}
+
+// call runs one request, return nil for notifications
+func (r *RPC) call(data []byte, src *rpcSource, conn *RPCConn) (resp *rpcResponse) {
+	msg := rpcMessage{}
+	err := json.Unmarshal(data, &msg)
+	if err != nil || msg.JSONRPC != "2.0" || msg.Method == "" {
+		return rpcErrorResponse(msg.ID, RPCInvalidRequest, "invalid request")
+	}
+	notification := len(msg.ID) == 0
+	r.mux.RLock()
+	handler, ok := r.methods[msg.Method]
+	r.mux.RUnlock()
+	if !ok {
+		if notification {
+			return nil
+		}
+		return rpcErrorResponse(msg.ID, RPCMethodNotFound, "method "+msg.Method+" not found")
+	}
+	call := &RPCCall{Method: msg.Method, Params: msg.Params, Req: src.request(), Conn: conn}
+	defer func() {
+		if rec := recover(); rec != nil {
+			rpcErr, isRPC := rec.(*RPCError)
+			if rec == "skip" { // req.Err* of the handler or middleware
+				rpcErr, isRPC = rpcSkipError(call.Req), true
+			}
+			if !isRPC {
+				if r.OnPanic != nil {
+					r.OnPanic(call, fmt.Sprintf("%v", rec)+"\n\n"+string(debug.Stack()))
+				} else {
+					fmt.Println("UNCATCHED PANIC", rec)
+					debug.PrintStack()
+				}
+				rpcErr = &RPCError{Code: RPCInternalError, Message: "internal error"}
+			}
+			resp = &rpcResponse{JSONRPC: "2.0", ID: msg.ID, Error: rpcErr}
+			if notification {
+				resp = nil
+			}
+		}
+	}()
+	result := handler(call)
+	if notification {
+		return nil
+	}
+	if result == nil {
+		result = json.RawMessage("null") // result is required in successful response
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: msg.ID, Result: result}
+}
+
+// rpcSkipError converts error response written by req.Err* to RPCError the same way RPCCall.ErrCode does
+func rpcSkipError(req *Request) *RPCError {
+	status := req.Ctx.Response.StatusCode()
+	data := H{}
+	json.Unmarshal(req.Ctx.Response.Body(), &data)
+	desc, _ := data["desc"].(string)
+	if desc == "" {
+		desc = fasthttp.StatusMessage(status)
+	}
+	data["status"] = status
+	return &RPCError{Code: RPCErrorCode(status), Message: desc, Data: data}
+}
+
+// rpcRejected answers calls of the message with internal error when connection has too many pending messages,
+// notifications are dropped
+func rpcRejected(data []byte) ([]*rpcResponse, bool) {
+	data = bytes.TrimSpace(data)
+	batch := len(data) > 0 && data[0] == '['
+	messages := []rpcMessage{}
+	if batch {
+		json.Unmarshal(data, &messages)
+	} else {
+		msg := rpcMessage{}
+		json.Unmarshal(data, &msg)
+		messages = append(messages, msg)
+	}
+	responses := []*rpcResponse{}
+	for _, msg := range messages {
+		if len(msg.ID) > 0 {
+			responses = append(responses, rpcErrorResponse(msg.ID, RPCInternalError, "too many pending calls"))
+		}
+	}
+	return responses, batch && len(responses) > 0
+}
+
+func rpcErrorResponse(id json.RawMessage, code int, message string) *rpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: &RPCError{Code: code, Message: message}}
+}
+
+// RPCConn is JSON-RPC over websocket, server could call client methods with it
+type RPCConn struct {
+	Socket  *Socket
+	Timeout time.Duration // time to wait for client answer, 30 seconds by default
+	lastID  int64
+	pending map[string]chan *rpcMessage
+	mux     sync.Mutex
+}
+
+// Call calls client method and decodes its result into result, which could be nil.
+// Client error is returned as *RPCError
+func (conn *RPCConn) Call(method string, params interface{}, result interface{}) error {
+	id := strconv.FormatInt(atomic.AddInt64(&conn.lastID, 1), 10)
+	ch := make(chan *rpcMessage, 1)
+	conn.mux.Lock()
+	if conn.pending == nil {
+		conn.mux.Unlock()
+		return ErrSocketClosed
+	}
+	conn.pending[id] = ch
+	conn.mux.Unlock()
+	defer func() {
+		conn.mux.Lock()
+		if conn.pending != nil {
+			delete(conn.pending, id)
+		}
+		conn.mux.Unlock()
+	}()
+	err := conn.send(json.RawMessage(id), method, params)
+	if err != nil {
+		return err
+	}
+	timer := time.NewTimer(conn.Timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return ErrSocketClosed
+		}
+		if msg.Error != nil {
+			return msg.Error
+		}
+		if result != nil {
+			return json.Unmarshal(msg.Result, result)
+		}
+		return nil
+	case <-timer.C:
+		return ErrRPCTimeout
+	}
+}
+
+// Notify sends notification to client, it does not wait for answer
+func (conn *RPCConn) Notify(method string, params interface{}) error {
+	return conn.send(nil, method, params)
+}
+
+func (conn *RPCConn) send(id json.RawMessage, method string, params interface{}) error {
+	msg := H{"jsonrpc": "2.0", "method": method}
+	if id != nil {
+		msg["id"] = id
+	}
+	if params != nil {
+		msg["params"] = params
+	}
+	return conn.Socket.SendValue(msg)
+}
+
+// response passes client answer to waiting Call, return false if data is not a response
+func (conn *RPCConn) response(data []byte) bool {
+	msg := rpcMessage{}
+	if len(data) == 0 || data[0] != '{' || json.Unmarshal(data, &msg) != nil {
+		return false
+	}
+	if msg.Method != "" || (msg.Result == nil && msg.Error == nil) {
+		return false
+	}
+	conn.mux.Lock()
+	if ch, ok := conn.pending[string(msg.ID)]; ok {
+		select {
+		case ch <- &msg:
+		default: // duplicate answer
+		}
+	}
+	conn.mux.Unlock()
+	return true
+}
+
+// closePending fails all waiting calls
+func (conn *RPCConn) closePending() {
+	conn.mux.Lock()
+	for _, ch := range conn.pending {
+		close(ch)
+	}
+	conn.pending = nil
+	conn.mux.Unlock()
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -13,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -25,16 +27,26 @@ import (
 
 // HTTP main type for http server
 type HTTP struct {
-	handlers  routerTree
-	OnError   func(req *Request, name, text string)
-	OnPanic   func(req *Request, stackTrace string)
-	OnRequest func(req *Request)
-	OnOptions func(req *Request)
-	CORS      string
-	server    *fasthttp.Server
-	started   bool // true if server is started
-	GZip      bool
-	mux       sync.Mutex
+	handlers    routerTree
+	middlewares []Middleware
+	Authorizer  Authorizer         // resolves principals for routes with required roles or scopes
+	RateLimit   RateLimitBackend   // used by req.Limit and limiters without own backend, in-memory by default
+	IPResolver  *IPResolver        // resolves client ip behind trusted proxies, only local proxies are trusted by default
+	DrainDelay  time.Duration      // time between readiness failing and server shutdown
+	Sockets     SocketOptions      // options of websocket upgrade
+	EventSource EventSourceOptions // options of event streams
+	health      *Health
+	activeSSE   int64
+	activeWS    int64
+	OnError     func(req *Request, name, text string)
+	OnPanic     func(req *Request, stackTrace string)
+	OnRequest   func(req *Request)
+	OnOptions   func(req *Request)
+	CORS        string
+	server      *fasthttp.Server
+	started     bool // true if server is started
+	GZip        bool
+	mux         sync.Mutex
 }
 
 // Request is an wrapper around fasthttp
@@ -42,11 +54,21 @@ type Request struct {
 	Ctx         *fasthttp.RequestCtx
 	Path        string
 	PathParams  map[string]string
-	ReferenceID int64 // used to point out userID during session
+	ReferenceID int64    // used to point out userID during session
+	Route       *Route   // route which handles the request
+	Group       *RestAPI // route group of the handler, nil for routes added with Handle
+	APIKey      *APIKey  // set when request is authenticated with api key
+	Span        *Span    // set by Tracer middleware, nil when request is not traced
+	Socket      *Socket  // set by UpgradeWS
 	http        *HTTP
 	OnResponse  func(interface{})
 	OnFail      func(int, string, interface{})
 	supportGZip bool
+	csrf        *CSRF
+	csrfToken   string
+	principal   *Principal
+	cacheTags   []string
+	revalidate  bool // background refresh of cached response, cache middleware passes it to the handler
 }
 
 func (req *Request) Write(data []byte) {
@@ -371,7 +393,7 @@ func (req *Request) ErrJSONP(code string, text interface{}) {
 		Code  string `json:"code"`
 		Error string `json:"error"`
 	}{
-		Code: code,
+		Code:  code,
 		Error: desc,
 	})
 	if req.http.OnError != nil {
@@ -557,12 +579,18 @@ func (req *Request) Background(handler func()) {
 	}()
 }
 
-// EventSource starts an event server
+// EventSource starts an event server with HTTP.EventSource options, stream is finished when callback returns
 func (req *Request) EventSource(callback func(*ServerEvents)) {
+	req.EventSourceOptions(&req.http.EventSource, callback)
+}
+
+// EventSourceOptions works like EventSource with custom options
+func (req *Request) EventSourceOptions(opts *EventSourceOptions, callback func(*ServerEvents)) {
 	req.Ctx.SetContentType("text/event-stream; charset=UTF-8")
 	req.Ctx.Response.Header.Set("Cache-Control", "no-cache")
 	req.Ctx.Response.Header.Set("Connection", "keep-alive")
 	req.Ctx.Response.Header.Set("Transfer-Encoding", "chunked")
+	req.Ctx.Response.Header.Set("X-Accel-Buffering", "no") // nginx should not buffer the stream
 	req.writeCORSHeader()
 	if req.http.CORS != "" {
 		req.Ctx.Response.Header.Set("Access-Control-Expose-Headers", "*")
@@ -574,8 +602,36 @@ func (req *Request) EventSource(callback func(*ServerEvents)) {
 		lastEventIDStr = req.GetParamOpt("last-event-id")
 	}
 	sessionID := req.GetSessionID()
+	conn := req.Ctx.Conn()
+	heartbeat := opts.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = time.Second * 15
+	}
+	timeout := opts.WriteTimeout
+	if timeout == 0 {
+		timeout = time.Second * 30
+	}
 
 	req.Ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		atomic.AddInt64(&req.http.activeSSE, 1)
+		defer atomic.AddInt64(&req.http.activeSSE, -1)
+		ctx, cancel := context.WithCancel(context.Background())
+		se := ServerEvents{
+			Writer:    w,
+			EventID:   I64(lastEventIDStr),
+			SessionID: sessionID,
+			Die:       make(chan bool),
+			conn:      conn,
+			timeout:   timeout,
+			ctx:       ctx,
+			cancel:    cancel,
+		}
+		defer func() {
+			se.close()
+			if conn != nil {
+				conn.SetWriteDeadline(time.Time{})
+			}
+		}()
 		defer func() {
 			if r := recover(); r != nil {
 				apiErrStr := fmt.Sprintf("%v", r)
@@ -589,10 +645,11 @@ func (req *Request) EventSource(callback func(*ServerEvents)) {
 				}
 			}
 		}()
-		se := ServerEvents{
-			Writer:    w,
-			EventID:   I64(lastEventIDStr),
-			SessionID: sessionID,
+		if opts.Retry > 0 && se.Retry(opts.Retry) != nil {
+			return
+		}
+		if heartbeat > 0 {
+			go se.heartbeat(heartbeat)
 		}
 		callback(&se)
 	})
@@ -652,25 +709,29 @@ func (req *Request) Env() *Environment {
 	return Env(req)
 }
 
-// GetRealIP will return ip address of user
+// GetRealIP will return ip address of user, proxy headers are trusted only from loopback addresses (local nginx)
+// unless other proxies are configured with SetTrustedProxies
 func (req *Request) GetRealIP() net.IP {
-	ip := req.GetHeader("X-Real-IP")
-	if ip == "" {
-		ipFWD := req.GetHeader("X-Forwarded-For")
-		fwdips := strings.Split(ipFWD, ", ")
-		if len(fwdips) > 0 {
-			ip = fwdips[0]
-		}
+	resolver := ipResolverDefault
+	if req.http != nil && req.http.IPResolver != nil {
+		resolver = req.http.IPResolver
 	}
-	IP := net.ParseIP(ip)
-	return IP
+	return resolver.Resolve(req.Ctx)
 }
 
 // Shutdown will gracefully shutdown the app, stopping receiving new connections but continue receive old one
+// if health endpoints are used readiness starts failing first and server waits DrainDelay for load balancers to notice it
 func (h *HTTP) Shutdown() error {
 	if !h.IsStarted() {
 		return nil
 	}
+	h.mux.Lock()
+	health := h.health
+	h.mux.Unlock()
+	if health != nil {
+		health.SetDraining(true)
+		time.Sleep(h.DrainDelay)
+	}
 	return h.server.Shutdown()
 }
 
@@ -682,77 +743,86 @@ func (h *HTTP) IsStarted() bool {
 	return isStarted
 }
 
-// Serve start handling HTTP requests using fasthttp
-func (h *HTTP) Serve(portHTTP string) {
-	ctxHanler := func(ctx *fasthttp.RequestCtx) {
-		req := Request{
-			Ctx:  ctx,
-			Path: string(ctx.Path()),
-			http: h,
-		}
-		if h.GZip {
-			gzipHeader := req.GetHeader("Accept-Encoding")
-			if gzipHeader == "*" || strings.Contains(gzipHeader, "gzip") {
-				req.supportGZip = true
-			}
+// serveCtx handles single fasthttp request
+func (h *HTTP) serveCtx(ctx *fasthttp.RequestCtx) {
+	req := Request{
+		Ctx:  ctx,
+		Path: string(ctx.Path()),
+		http: h,
+	}
+	if h.GZip {
+		gzipHeader := req.GetHeader("Accept-Encoding")
+		if gzipHeader == "*" || strings.Contains(gzipHeader, "gzip") {
+			req.supportGZip = true
 		}
-		defer func() {
-			if r := recover(); r != nil {
-				apiErrStr := fmt.Sprintf("%v", r)
-				if apiErrStr != "skip" {
-					if h.OnPanic != nil {
-						h.OnPanic(&req, apiErrStr+"\n\n"+string(debug.Stack()))
-					} else {
-						fmt.Println("UNCATCHED PANIC", r)
-						debug.PrintStack()
-					}
-					// this error do not panic
-					req.SendError(500, "fatal", "runtime error")
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			apiErrStr := fmt.Sprintf("%v", r)
+			if apiErrStr != "skip" {
+				if h.OnPanic != nil {
+					h.OnPanic(&req, apiErrStr+"\n\n"+string(debug.Stack()))
+				} else {
+					fmt.Println("UNCATCHED PANIC", r)
+					debug.PrintStack()
 				}
-			}
-		}()
-		methodStr := req.Method()
-		if methodStr == "OPTIONS" {
-			if h.OnOptions != nil {
-				h.OnOptions(&req)
-				return
-			}
-			if req.http.CORS != "" {
-				req.SetHeader("Access-Control-Allow-Methods", "POST, GET, OPTIONS, DELETE, PATCH, UPDATE")
-				req.SetHeader("Access-Control-Allow-Headers", "*")
-				req.RespOk()
-				return
+				// this error do not panic
+				req.SendError(500, "fatal", "runtime error")
 			}
 		}
-		method, ok := Methods[methodStr]
-		if !ok {
-			req.Err("invalid_request", "Unsupported method")
+	}()
+	methodStr := req.Method()
+	if methodStr == "OPTIONS" {
+		if h.OnOptions != nil {
+			h.OnOptions(&req)
 			return
 		}
-
-		cb, params, err := h.handlers.Route(method, req.Path)
-		if cb == nil {
-			req.Err("not_found", err)
+		if req.http.CORS != "" {
+			req.SetHeader("Access-Control-Allow-Methods", "POST, GET, OPTIONS, DELETE, PATCH, UPDATE")
+			req.SetHeader("Access-Control-Allow-Headers", "*")
+			req.RespOk()
 			return
 		}
-		req.PathParams = params
-		if req.http.OnRequest != nil {
-			req.http.OnRequest(&req)
-		}
-		cb(&req)
-		//elapsed := time.Since(start)
+	}
+	method, ok := Methods[methodStr]
+	if !ok {
+		req.Err("invalid_request", "Unsupported method")
+		return
 	}
 
+	handler, params, err := h.handlers.Route(method, req.Path)
+	if handler == nil {
+		req.Err("not_found", err)
+		return
+	}
+	req.PathParams = params
+	req.Route = handler.Route
+	if handler.Route != nil {
+		req.Group = handler.Route.Group
+	}
+	if req.http.OnRequest != nil {
+		req.http.OnRequest(&req)
+	}
+	h.handle(&req, handler.Handle)
+	//elapsed := time.Since(start)
+}
+
+// Serve start handling HTTP requests using fasthttp
+func (h *HTTP) Serve(portHTTP string) {
 	//fasthttp.DialTimeout(addr, 24*time.Hour)
+	h.checkRoutes()
 	log.Println("Server started, port", portHTTP)
 
 	// NOTE: Package reuseport provides a TCP net.Listener with SO_REUSEPORT support.
 	// SO_REUSEPORT allows linear scaling server performance on multi-CPU servers.
 	ln, err := reuseport.Listen("tcp4", ":"+portHTTP)
+	h.mux.Lock()
 	h.server = &fasthttp.Server{
-		Handler:               ctxHanler,
+		Handler:               h.serveCtx,
 		NoDefaultServerHeader: true,
 	}
+	h.started = true
+	h.mux.Unlock()
 	if err == nil {
 		err = h.server.Serve(ln)
 	} else {
@@ -764,14 +834,20 @@ func (h *HTTP) Serve(portHTTP string) {
 		log.Fatalf("Error in start server: %s", err)
 	} else {
 		h.mux.Lock()
-		h.started = true
+		h.started = false
 		h.mux.Unlock()
 	}
 }
 
 // Handle add callback to
-func (h *HTTP) Handle(path string, callback func(req *Request)) {
-	h.handlers.Handle(Methods["*"], path, callback)
+func (h *HTTP) Handle(path string, callback func(req *Request)) *Route {
+	route := &Route{
+		Method: "*",
+		Path:   routePath(strings.Split(path, "/")),
+		Handle: callback,
+	}
+	h.handlers.Handle(Methods["*"], path, callback, route)
+	return route
 }
 
 // SetCORS setup cors header for the api
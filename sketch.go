@@ -0,0 +1,119 @@
+package zero
+
+import "math"
+
+// StatSketchAccuracy is relative error of quantiles returned by StatSketch
+const StatSketchAccuracy = 0.02
+
+// statSketchBuckets covers all positive int64 values with StatSketchAccuracy
+const statSketchBuckets = 1100
+
+var statSketchGamma = (1 + StatSketchAccuracy) / (1 - StatSketchAccuracy)
+var statSketchLogGamma = math.Log(statSketchGamma)
+
+// StatSketch is a mergeable quantile sketch with fixed memory,
+// values are counted in logarithmic buckets so every quantile has bounded relative error
+type StatSketch struct {
+	buckets  [statSketchBuckets]uint64
+	zero     uint64 // values <= 0
+	Count    uint64
+	Sum      int64
+	Min      int64
+	Max      int64
+	hasValue bool
+}
+
+func statSketchIndex(v int64) int {
+	idx := int(math.Ceil(math.Log(float64(v)) / statSketchLogGamma))
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= statSketchBuckets {
+		idx = statSketchBuckets - 1
+	}
+	return idx
+}
+
+// Add puts value to the sketch
+func (s *StatSketch) Add(v int64) {
+	if v <= 0 {
+		s.zero++
+	} else {
+		s.buckets[statSketchIndex(v)]++
+	}
+	s.Count++
+	s.Sum += v
+	if !s.hasValue || v < s.Min {
+		s.Min = v
+	}
+	if !s.hasValue || v > s.Max {
+		s.Max = v
+	}
+	s.hasValue = true
+}
+
+// Merge adds all values of another sketch, sketches from different nodes could be merged this way
+func (s *StatSketch) Merge(o *StatSketch) {
+	if o == nil || !o.hasValue {
+		return
+	}
+	for i, c := range o.buckets {
+		s.buckets[i] += c
+	}
+	s.zero += o.zero
+	s.Count += o.Count
+	s.Sum += o.Sum
+	if !s.hasValue || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if !s.hasValue || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.hasValue = true
+}
+
+// Mean return average of values
+func (s *StatSketch) Mean() int64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / int64(s.Count)
+}
+
+// Quantile return approximate value for quantile q from 0 to 1, like 0.99 for p99
+func (s *StatSketch) Quantile(q float64) int64 {
+	if s.Count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.Min
+	}
+	if q >= 1 {
+		return s.Max
+	}
+	rank := uint64(q * float64(s.Count-1))
+	if rank < s.zero {
+		return s.Min
+	}
+	seen := s.zero
+	for i, c := range s.buckets {
+		seen += c
+		if seen > rank {
+			// middle of the bucket in terms of relative error
+			v := int64(2 * math.Pow(statSketchGamma, float64(i)) / (statSketchGamma + 1))
+			if v < s.Min {
+				v = s.Min
+			}
+			if v > s.Max {
+				v = s.Max
+			}
+			return v
+		}
+	}
+	return s.Max
+}
+
+// Reset clears the sketch
+func (s *StatSketch) Reset() {
+	*s = StatSketch{}
+}
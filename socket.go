@@ -2,20 +2,174 @@ package zero
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Close codes of websocket connection, defined in RFC 6455
+const (
+	SocketCloseNormal          = websocket.CloseNormalClosure
+	SocketCloseGoingAway       = websocket.CloseGoingAway
+	SocketCloseProtocolError   = websocket.CloseProtocolError
+	SocketClosePolicyViolation = websocket.ClosePolicyViolation
+	SocketCloseTooBig          = websocket.CloseMessageTooBig
+	SocketCloseInternalError   = websocket.CloseInternalServerErr
+	// SocketCloseAbnormal is set when connection was lost without close frame, it is never sent
+	SocketCloseAbnormal = websocket.CloseAbnormalClosure
+)
+
+// Message types of websocket frames
+const (
+	SocketText   = websocket.TextMessage
+	SocketBinary = websocket.BinaryMessage
 )
 
+// SocketMaxMessageSize is default limit of incoming messages
+const SocketMaxMessageSize = 1 << 20
+
+// ErrSocketClosed is returned when sending to finished socket
+var ErrSocketClosed = errors.New("socket is closed")
+
+// SocketCodec encodes values sent with SendValue and decodes incoming messages with Decode
+type SocketCodec struct {
+	MessageType int // SocketText or SocketBinary
+	Marshal     func(v interface{}) ([]byte, error)
+	Unmarshal   func(data []byte, v interface{}) error
+}
+
+// SocketCodecs maps Sec-WebSocket-Protocol names to codecs, "json" is used when client asks no protocol
+var SocketCodecs = map[string]*SocketCodec{
+	"json":    {MessageType: SocketText, Marshal: json.Marshal, Unmarshal: json.Unmarshal},
+	"msgpack": {MessageType: SocketBinary, Marshal: MsgPackMarshal, Unmarshal: MsgPackUnmarshal},
+}
+
+// SocketOptions configures websocket upgrade, they are set for the server with HTTP.Sockets
+type SocketOptions struct {
+	// Protocols are offered for Sec-WebSocket-Protocol negotiation in order of preference, names are keys of SocketCodecs.
+	// Client which asks no protocol gets json
+	Protocols []string
+	// Compression enables per-message deflate if client supports it
+	Compression bool
+	// CompressionLevel is flate level from 1 to 9, 1 by default
+	CompressionLevel int
+	// CompressionMinSize is a size of messages from which they are compressed, 512 bytes by default
+	CompressionMinSize int
+	// MaxMessageSize closes connection with SocketCloseTooBig if peer sends bigger message,
+	// SocketMaxMessageSize by default, negative value means no limit
+	MaxMessageSize int64
+	// CheckOrigin allows the request Origin, all origins are allowed if it is nil
+	CheckOrigin func(req *Request) bool
+}
+
+type socketFrame struct {
+	kind int
+	data []byte
+}
+
 // RespService service message type
 type RespService struct {
 	Type string `json:"type"`
 }
 
-// Socket is an
+// Socket is a websocket connection, it lives until Close is called,
+// the peer closes it or stops answering pings
 type Socket struct {
+	// Write takes text messages to send, they are moved to the send queue by background goroutine,
+	// so they are not ordered with Send and are dropped when socket is finished.
+	//
+	// Deprecated: use Send which keeps order and does not block on finished socket
 	Write  chan []byte
-	Read   chan []byte
-	Die    chan bool
+	Read   chan []byte // incoming messages if OnMessage is not set, reader waits for consumer instead of dropping messages
+	Die    chan bool   // closed when socket is finished
 	Finish bool
+	// OnMessage is called from reader goroutine for every incoming message, Read is not used if it is set
+	OnMessage func(soc *Socket, data []byte)
+	// OnBinary is called for binary messages, they go to OnMessage or Read if it is nil
+	OnBinary func(soc *Socket, data []byte)
+	// OnClose is called once after connection is closed and all socket goroutines are finished,
+	// code is SocketCloseAbnormal if connection was lost
+	OnClose      func(soc *Socket, code int, reason string)
+	PingInterval time.Duration // 30 seconds by default, pings are not sent if it is 0 or less
+	PongTimeout  time.Duration // peer is dead if nothing is received during it, 60 seconds by default
+	WriteTimeout time.Duration // 10 seconds by default
+	CloseCode    int           // set when socket is finished
+	CloseReason  string
+	Protocol     string       // negotiated Sec-WebSocket-Protocol, empty if client asked none
+	Codec        *SocketCodec // codec of the protocol, json by default
+	compressMin  int
+	queue        chan socketFrame
+	conn         *websocket.Conn
+	closing      bool // Close was called, queued messages are sent before close frame
+	closeOnce    sync.Once
+	mux          sync.Mutex
+}
+
+// SocketNew creates socket with default timeouts, it is connected by UpgradeWS
+func SocketNew() *Socket {
+	return &Socket{
+		Write:        make(chan []byte, 64),
+		Read:         make(chan []byte, 64),
+		Die:          make(chan bool),
+		Codec:        SocketCodecs["json"],
+		queue:        make(chan socketFrame, 64),
+		PingInterval: time.Second * 30,
+		PongTimeout:  time.Second * 60,
+		WriteTimeout: time.Second * 10,
+	}
+}
+
+// Send queues text message for sending, return ErrSocketClosed if socket is finished
+func (soc *Socket) Send(data []byte) error {
+	return soc.SendFrame(SocketText, data)
+}
+
+// SendBinary queues binary message for sending
+func (soc *Socket) SendBinary(data []byte) error {
+	return soc.SendFrame(SocketBinary, data)
+}
+
+// SendValue encodes value with the negotiated codec and queues it
+func (soc *Socket) SendValue(v interface{}) error {
+	data, err := soc.Codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return soc.SendFrame(soc.Codec.MessageType, data)
+}
+
+// Decode decodes incoming message with the negotiated codec
+func (soc *Socket) Decode(data []byte, v interface{}) error {
+	return soc.Codec.Unmarshal(data, v)
+}
+
+// SendFrame queues message of the type, SocketText or SocketBinary
+func (soc *Socket) SendFrame(messageType int, data []byte) error {
+	select {
+	case <-soc.Die:
+		return ErrSocketClosed
+	default:
+	}
+	select {
+	case soc.queue <- socketFrame{messageType, data}:
+		return nil
+	case <-soc.Die:
+		return ErrSocketClosed
+	}
+}
+
+// IsClosed return true if socket is finished
+func (soc *Socket) IsClosed() bool {
+	select {
+	case <-soc.Die:
+		return true
+	default:
+		return false
+	}
 }
 
 // Fatal push an fatal error to the socket
@@ -32,13 +186,191 @@ func (soc *Socket) Fatal(code string, text interface{}) {
 		Fatal interface{} `json:"fatal"`
 	}{data}
 	json, _ := json.Marshal(dataWraped)
-	soc.Write <- json
+	soc.Send(json)
 }
 
 // Kill end end conection
 func (soc *Socket) Kill() {
-	soc.Finish = true
-	soc.Die <- true
+	soc.Close(SocketCloseNormal, "")
+}
+
+// Close finishes the socket, messages already queued with Send are sent before close frame with the code and reason.
+// It does not block, new messages are rejected with ErrSocketClosed
+func (soc *Socket) Close(code int, reason string) {
+	if len(reason) > 123 { // control frame payload is limited to 125 bytes
+		reason = reason[:123]
+	}
+	soc.finish(code, reason, true)
+}
+
+// finish marks socket as finished once, return false if it was already finished
+func (soc *Socket) finish(code int, reason string, closing bool) bool {
+	done := false
+	soc.closeOnce.Do(func() {
+		soc.mux.Lock()
+		soc.CloseCode = code
+		soc.CloseReason = reason
+		soc.Finish = true
+		soc.closing = closing
+		soc.mux.Unlock()
+		close(soc.Die)
+		done = true
+	})
+	return done
+}
+
+// abort finishes the socket after connection error and stops the reader
+func (soc *Socket) abort(c *websocket.Conn, reason string) {
+	soc.finish(SocketCloseAbnormal, reason, false)
+	c.Close()
+}
+
+// flush sends messages queued before Close and close frame, then waits for the peer to answer with close frame, but not forever
+func (soc *Socket) flush(c *websocket.Conn) {
+	soc.mux.Lock()
+	closing := soc.closing
+	soc.mux.Unlock()
+	if !closing {
+		return
+	}
+	for len(soc.queue) > 0 { // nobody else reads the queue
+		frame := <-soc.queue
+		if !soc.write(c, frame.kind, frame.data) {
+			return
+		}
+	}
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(soc.CloseCode, soc.CloseReason), time.Now().Add(soc.WriteTimeout))
+	c.SetReadDeadline(time.Now().Add(soc.WriteTimeout))
+}
+
+// run serves connection until it is finished, it is called in connection goroutine
+func (soc *Socket) run(c *websocket.Conn, onOpen func()) {
+	soc.mux.Lock()
+	soc.conn = c
+	soc.mux.Unlock()
+	if soc.IsClosed() { // closed before handshake was done
+		soc.flush(c)
+	} else {
+		c.SetReadDeadline(time.Now().Add(soc.PongTimeout))
+		c.SetPongHandler(func(string) error {
+			c.SetReadDeadline(time.Now().Add(soc.PongTimeout))
+			return nil
+		})
+		writerDone := make(chan bool)
+		go soc.writer(c, writerDone)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Println("UNCATCHED PANIC", r)
+					debug.PrintStack()
+					soc.abort(c, fmt.Sprintf("%v", r))
+				}
+			}()
+			onOpen()
+			soc.reader(c)
+		}()
+		<-writerDone
+	}
+	c.Close()
+	if soc.OnClose != nil {
+		soc.OnClose(soc, soc.CloseCode, soc.CloseReason)
+	}
+}
+
+// reader reads messages until connection is closed
+func (soc *Socket) reader(c *websocket.Conn) {
+	for {
+		messageType, message, err := c.ReadMessage()
+		if err != nil {
+			if closeErr, ok := err.(*websocket.CloseError); ok {
+				soc.finish(closeErr.Code, closeErr.Text, false)
+			} else if err == websocket.ErrReadLimit {
+				soc.finish(SocketCloseTooBig, "message is too big", false)
+			} else {
+				soc.finish(SocketCloseAbnormal, err.Error(), false)
+			}
+			return
+		}
+		if internalMetrics != nil {
+			internalMetrics.wsMessages.Inc("in")
+		}
+		if soc.IsClosed() {
+			// keep reading until close frame of the peer or deadline set by Close
+			continue
+		}
+		if messageType == SocketBinary && soc.OnBinary != nil {
+			soc.OnBinary(soc, message)
+		} else if soc.OnMessage != nil {
+			soc.OnMessage(soc, message)
+		} else {
+			select {
+			case soc.Read <- message:
+			case <-soc.Die:
+				continue
+			}
+		}
+		if !soc.IsClosed() {
+			c.SetReadDeadline(time.Now().Add(soc.PongTimeout))
+		}
+	}
+}
+
+// writer sends queued messages and pings until socket is finished, it is the only goroutine writing messages
+func (soc *Socket) writer(c *websocket.Conn, done chan bool) {
+	defer close(done)
+	go soc.forward()
+	var tick <-chan time.Time
+	if soc.PingInterval > 0 {
+		ticker := time.NewTicker(soc.PingInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case frame := <-soc.queue:
+			if !soc.write(c, frame.kind, frame.data) {
+				return
+			}
+		case <-tick:
+			err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(soc.WriteTimeout))
+			if err != nil {
+				soc.abort(c, err.Error())
+				return
+			}
+		case <-soc.Die:
+			soc.flush(c)
+			return
+		}
+	}
+}
+
+// forward moves messages of Write channel to the send queue
+func (soc *Socket) forward() {
+	for {
+		select {
+		case message := <-soc.Write:
+			if soc.SendFrame(SocketText, message) != nil {
+				return
+			}
+		case <-soc.Die:
+			return
+		}
+	}
+}
+
+// write sends message, small messages are not compressed
+func (soc *Socket) write(c *websocket.Conn, messageType int, data []byte) bool {
+	c.EnableWriteCompression(len(data) >= soc.compressMin)
+	c.SetWriteDeadline(time.Now().Add(soc.WriteTimeout))
+	err := c.WriteMessage(messageType, data)
+	if err != nil {
+		soc.abort(c, err.Error())
+		return false
+	}
+	if internalMetrics != nil {
+		internalMetrics.wsMessages.Inc("out")
+	}
+	return true
 }
 
 // Send an service event to the user
@@ -50,5 +382,5 @@ func (soc *Socket) Service(serviceType string) {
 		Service *RespService `json:"service"`
 	}{&service}
 	json, _ := json.Marshal(dataWraped)
-	soc.Write <- json
+	soc.Send(json)
 }
@@ -1,6 +1,9 @@
 package zero
 
 import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -10,81 +13,273 @@ type StatCounter struct {
 	Count      int64
 	Elapsed    int64
 	MaxElapsed int64
+	// fields below are filled for counters updated with Time
+	Min    int64
+	Mean   int64
+	P50    int64
+	P90    int64
+	P95    int64
+	P99    int64
+	Sketch *StatSketch // distribution of times, could be merged with sketches of other nodes
+	// Value is set for counters updated with Gauge
+	Value   int64
+	IsGauge bool
 }
 
+// Quantile return approximate time for quantile q from 0 to 1
+func (c *StatCounter) Quantile(q float64) int64 {
+	if c.Sketch == nil {
+		return 0
+	}
+	return c.Sketch.Quantile(q)
+}
+
+// fillQuantiles sets summary fields from sketch
+func (c *StatCounter) fillQuantiles() {
+	if c.Sketch == nil {
+		return
+	}
+	c.Min = c.Sketch.Min
+	c.Mean = c.Sketch.Mean()
+	c.P50 = c.Sketch.Quantile(0.5)
+	c.P90 = c.Sketch.Quantile(0.9)
+	c.P95 = c.Sketch.Quantile(0.95)
+	c.P99 = c.Sketch.Quantile(0.99)
+}
+
+// statShards is number of independently locked parts of Stat, events with different names rarely wait for each other
+const statShards = 32
+
+// StatMaxNames is default limit of distinct names during one period, events with new names above it are dropped
+const StatMaxNames = 10000
+
+// StatGaugeIdle is default number of periods gauge is exported without updates before it is removed
+const StatGaugeIdle = 10
+
 // Stat main type for stat watch
 type Stat struct {
-	counter     map[string]StatCounter
-	counterChan chan StatCounter
+	MaxNames    int // limit of distinct names per period, StatMaxNames if not set
+	GaugeIdle   int // periods gauge is kept without updates, StatGaugeIdle if not set
+	shards      [statShards]statShard
+	gauges      map[string]*statGauge
+	gaugesMux   sync.Mutex
+	names       int64 // distinct names in current period
+	dropped     int64
+	exporters   []StatExporter
+	exportersMx sync.Mutex
+	cb          func(string, StatCounter)
+	stop        chan bool
+	stopped     chan bool
+	started     int32
+}
+
+type statGauge struct {
+	value int64
+	idle  int // periods since last update
 }
 
-// Init allow to set stats update time
+type statShard struct {
+	counter map[string]*StatCounter
+	mux     sync.Mutex
+}
+
+// AddExporter sends counters to the exporter every period in addition to the callback
+func (s *Stat) AddExporter(exporter StatExporter) {
+	if closer, ok := exporter.(statExporterCloser); ok {
+		closer.attach()
+	}
+	s.exportersMx.Lock()
+	s.exporters = append(s.exporters, exporter)
+	s.exportersMx.Unlock()
+}
+
+// Init allow to set stats update time, cb could be nil if only exporters are used.
+// Periods are aligned to wall clock, so with a minute duration counters are flushed at the start of every minute
 func (s *Stat) Init(duration time.Duration, cb func(string, StatCounter)) {
-	s.counter = map[string]StatCounter{}
-	s.counterChan = make(chan StatCounter, 100)
+	if !atomic.CompareAndSwapInt32(&s.started, 0, 1) {
+		return
+	}
+	s.cb = cb
+	s.stop = make(chan bool)
+	s.stopped = make(chan bool)
 	go func() {
-		ticker := time.NewTicker(duration)
+		defer close(s.stopped)
 		for {
+			now := time.Now()
+			next := now.Truncate(duration).Add(duration)
+			timer := time.NewTimer(next.Sub(now))
 			select {
-			case e := <-s.counterChan:
-				counter, ok := s.counter[e.Name]
-				if !ok {
-					counter = StatCounter{Name: e.Name}
-				}
-				counter.Count += e.Count
-				if e.Elapsed != 0 {
-					counter.Elapsed += e.Elapsed
-					if e.Elapsed > counter.MaxElapsed {
-						counter.MaxElapsed = e.Elapsed
-					}
-				}
-				s.counter[e.Name] = counter
-			case <-ticker.C:
-				for k, v := range s.counter {
-					cb(k, v)
-				}
-				// Clean all counts
-				s.counter = map[string]StatCounter{}
+			case <-timer.C:
+				s.flush(next)
+			case <-s.stop:
+				timer.Stop()
+				s.flush(time.Now())
+				return
 			}
 		}
 	}()
 }
 
+// Stop flushes counters of the current partial period and stops the stat,
+// exporters send the last batch before it returns
+func (s *Stat) Stop() {
+	if !atomic.CompareAndSwapInt32(&s.started, 1, 2) {
+		return
+	}
+	close(s.stop)
+	<-s.stopped
+	s.exportersMx.Lock()
+	exporters := s.exporters
+	s.exportersMx.Unlock()
+	for _, exporter := range exporters {
+		if closer, ok := exporter.(statExporterCloser); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Dropped return number of events dropped because of names limit or because stat was not started
+func (s *Stat) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// flush takes counters of the period and passes them to the callback and exporters
+func (s *Stat) flush(now time.Time) {
+	counters := []*StatCounter{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.mux.Lock()
+		for _, counter := range shard.counter {
+			counters = append(counters, counter)
+		}
+		// names are released together with the swap, so new names of the next period are not counted twice
+		atomic.AddInt64(&s.names, -int64(len(shard.counter)))
+		shard.counter = nil
+		shard.mux.Unlock()
+	}
+	maxIdle := s.GaugeIdle
+	if maxIdle == 0 {
+		maxIdle = StatGaugeIdle
+	}
+	s.gaugesMux.Lock()
+	for name, gauge := range s.gauges {
+		if gauge.idle >= maxIdle {
+			delete(s.gauges, name)
+			continue
+		}
+		gauge.idle++
+		counters = append(counters, &StatCounter{Name: name, Value: gauge.value, IsGauge: true})
+	}
+	s.gaugesMux.Unlock()
+
+	s.exportersMx.Lock()
+	exporters := s.exporters
+	s.exportersMx.Unlock()
+	for _, counter := range counters {
+		counter.fillQuantiles()
+		if s.cb != nil {
+			s.cb(counter.Name, *counter)
+		}
+		for _, exporter := range exporters {
+			exporter.Export(counter.Name, *counter, now)
+		}
+	}
+	for _, exporter := range exporters {
+		exporter.Flush()
+	}
+}
+
+// update finds counter of the name and changes it under the shard lock
+func (s *Stat) update(name string, fn func(counter *StatCounter)) {
+	if atomic.LoadInt32(&s.started) != 1 {
+		atomic.AddInt64(&s.dropped, 1)
+		return
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	shard := &s.shards[hash.Sum32()%statShards]
+	shard.mux.Lock()
+	defer shard.mux.Unlock()
+	counter, ok := shard.counter[name]
+	if !ok {
+		maxNames := s.MaxNames
+		if maxNames == 0 {
+			maxNames = StatMaxNames
+		}
+		if atomic.AddInt64(&s.names, 1) > int64(maxNames) {
+			atomic.AddInt64(&s.names, -1)
+			atomic.AddInt64(&s.dropped, 1)
+			return
+		}
+		if shard.counter == nil {
+			shard.counter = map[string]*StatCounter{}
+		}
+		counter = &StatCounter{Name: name}
+		shard.counter[name] = counter
+	}
+	fn(counter)
+}
+
 // Inc increment
 func (s *Stat) Inc(name string) {
-	select {
-	case s.counterChan <- StatCounter{
-		Name:  name,
-		Count: 1,
-	}:
-	default:
-	}
+	s.Add(name, 1)
+}
+
+// Add increments counter by n
+func (s *Stat) Add(name string, n int64) {
+	s.update(name, func(counter *StatCounter) {
+		counter.Count += n
+	})
 }
 
 // Time increment
 func (s *Stat) Time(name string, time int64) {
-	select {
-	case s.counterChan <- StatCounter{
-		Name:    name,
-		Count:   1,
-		Elapsed: time,
-	}:
-	default:
+	s.update(name, func(counter *StatCounter) {
+		counter.Count++
+		counter.Elapsed += time
+		if time > counter.MaxElapsed {
+			counter.MaxElapsed = time
+		}
+		if counter.Sketch == nil {
+			counter.Sketch = &StatSketch{}
+		}
+		counter.Sketch.Add(time)
+	})
+}
+
+// Gauge sets current value, gauges keep last value and are passed to the callback every period
+// until they are not updated for GaugeIdle periods
+func (s *Stat) Gauge(name string, value int64) {
+	if atomic.LoadInt32(&s.started) != 1 {
+		atomic.AddInt64(&s.dropped, 1)
+		return
 	}
+	s.gaugesMux.Lock()
+	if s.gauges == nil {
+		s.gauges = map[string]*statGauge{}
+	}
+	s.gauges[name] = &statGauge{value: value}
+	s.gaugesMux.Unlock()
+}
+
+// RemoveGauge stops exporting gauge
+func (s *Stat) RemoveGauge(name string) {
+	s.gaugesMux.Lock()
+	delete(s.gauges, name)
+	s.gaugesMux.Unlock()
 }
 
 // StatDay return number of the day as int
 func StatDay() int64 {
-	return Now() / 86400
+	return CounterBucket(CounterDay, time.Now())
 }
 
 // StatHour return number of hour as int
 func StatHour() int64 {
-	return Now() / 3600
+	return CounterBucket(CounterHour, time.Now())
 }
 
 // StatMonth return number of month
 func StatMonth() int64 {
-	now := time.Now()
-	return int64(now.Year()*100) + int64(now.Month())
+	return CounterBucket(CounterMonth, time.Now())
 }
@@ -0,0 +1,114 @@
+package zero
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/fasthttp/websocket"
+)
+
+// StreamMessage is a Queue event sent to websocket by StreamQueue
+type StreamMessage struct {
+	ID    int64       `json:"id,omitempty"`
+	Key   string      `json:"key,omitempty"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// streamResume is a message client sends to websocket to get events it missed
+type streamResume struct {
+	Resume int64 `json:"resume"`
+}
+
+// StreamQueue streams events of the queue keys to websocket or event source depending on the request.
+// Events stored in history since Last-Event-ID header or last-event-id param are sent first, then live events.
+// Websocket client could also send {"resume": lastEventID} at any time to get missed events again.
+// Event "drop" is sent when history was truncated and client should reload its state.
+// Client which does not keep up is disconnected, websocket is closed with going away code and "resume" reason,
+// it should reconnect with the last event id. Subscriptions are removed when client disconnects
+func (req *Request) StreamQueue(q *Queue, keys ...string) {
+	if websocket.FastHTTPIsWebSocketUpgrade(req.Ctx) {
+		lastEventID := I64(req.GetHeader("Last-Event-ID"))
+		if lastEventID == 0 {
+			lastEventID = req.GetParamInt64("last-event-id")
+		}
+		req.streamSocket(q, keys, lastEventID)
+		return
+	}
+	req.EventSource(func(se *ServerEvents) {
+		stop := make(chan bool)
+		defer close(stop)
+		events, drop := q.Follow(keys, se.EventID, stop)
+		if drop && se.Write(0, "drop", []byte("{}")) != nil {
+			return
+		}
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok || se.Write(event.ID, event.Type, event.Data) != nil {
+					return
+				}
+			case <-se.Die: // heartbeat failed, client is gone
+				return
+			}
+		}
+	})
+}
+
+func (req *Request) streamSocket(q *Queue, keys []string, lastEventID int64) {
+	// events are followed before upgrade, so nothing is lost while handshake is finished
+	stop := make(chan bool)
+	events, drop := q.Follow(keys, lastEventID, stop)
+	soc := req.UpgradeWS(nil)
+	resume := make(chan int64, 1)
+	soc.OnMessage = func(soc *Socket, data []byte) {
+		msg := streamResume{}
+		if soc.Decode(data, &msg) == nil && msg.Resume > 0 {
+			select {
+			case resume <- msg.Resume:
+			default:
+			}
+		}
+	}
+	go func() {
+		defer func() { close(stop) }()
+		for {
+			if drop && soc.SendValue(StreamMessage{Event: "drop"}) != nil {
+				return
+			}
+			drop = false
+			select {
+			case event, ok := <-events:
+				if !ok { // follower was too slow, client reconnects from its last event
+					soc.Close(SocketCloseGoingAway, "resume")
+					return
+				}
+				if soc.SendValue(StreamMessage{
+					ID:    event.ID,
+					Key:   strings.TrimPrefix(event.Key, "q."),
+					Event: event.Type,
+					Data:  streamData(event.Data),
+				}) != nil {
+					return
+				}
+			case id := <-resume: // follow again from the position of the client
+				close(stop)
+				stop = make(chan bool)
+				events, drop = q.Follow(keys, id, stop)
+			case <-soc.Die:
+				return
+			}
+		}
+	}()
+}
+
+// streamData keeps json payload as is, other payloads are sent as string
+func streamData(data []byte) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	return string(data)
+}
@@ -0,0 +1,500 @@
+package zero
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	// SpanKindInternal is an operation inside the app
+	SpanKindInternal = 1
+	// SpanKindServer is handling of incoming request
+	SpanKindServer = 2
+	// SpanKindClient is an outgoing request, like database query
+	SpanKindClient = 3
+	// SpanKindProducer is sending of async message, like Queue push
+	SpanKindProducer = 4
+	// SpanKindConsumer is processing of async message
+	SpanKindConsumer = 5
+)
+
+const (
+	// SpanStatusUnset is default status
+	SpanStatusUnset = 0
+	// SpanStatusOk marks operation as successful
+	SpanStatusOk = 1
+	// SpanStatusError marks operation as failed
+	SpanStatusError = 2
+)
+
+// SpanContext identifies span across processes
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid return false for empty context
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// TraceParent formats context as W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceParent parses W3C traceparent header value
+func ParseTraceParent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.New("traceparent has invalid format")
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, errors.New("traceparent has invalid format")
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return sc, err
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return sc, err
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, err
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	if !sc.IsValid() {
+		return sc, errors.New("traceparent has zero ids")
+	}
+	return sc, nil
+}
+
+// Span is a single timed operation of the trace
+type Span struct {
+	Context    SpanContext
+	ParentID   [8]byte
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	Attributes H
+	Status     int
+	StatusText string
+	tracer     *Tracer
+	ended      int32
+	mux        sync.Mutex
+}
+
+// SetAttr sets attribute of the span, values should be string, bool, int, int64 or float64
+func (s *Span) SetAttr(key string, value interface{}) *Span {
+	if s == nil {
+		return s
+	}
+	s.mux.Lock()
+	s.Attributes[key] = value
+	s.mux.Unlock()
+	return s
+}
+
+// SetError marks span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	s.Status = SpanStatusError
+	s.StatusText = err.Error()
+	s.mux.Unlock()
+}
+
+// SetStatus sets status of the span
+func (s *Span) SetStatus(status int, text string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	s.Status = status
+	s.StatusText = text
+	s.mux.Unlock()
+}
+
+// Finish ends the span and passes it to exporter if it is sampled
+func (s *Span) Finish() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.End = time.Now()
+	if s.Context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Child starts new span inside this one, nil span creates nothing and return nil,
+// so all Span methods are safe to use when tracing is disabled
+func (s *Span) Child(name string, kind int) *Span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(s.Context, true, name, kind)
+}
+
+// Trace runs fn inside child span and records its error
+func (s *Span) Trace(name string, fn func() error) error {
+	child := s.Child(name, SpanKindInternal)
+	err := fn()
+	child.SetError(err)
+	child.Finish()
+	return err
+}
+
+// TraceParent return traceparent header value to pass to other services, empty for nil span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return s.Context.TraceParent()
+}
+
+// Inject adds traceparent header to outgoing fasthttp request
+func (s *Span) Inject(header *fasthttp.RequestHeader) {
+	if s != nil {
+		header.Set("traceparent", s.TraceParent())
+	}
+}
+
+// InjectHTTP adds traceparent header to outgoing net/http request
+func (s *Span) InjectHTTP(header http.Header) {
+	if s != nil {
+		header.Set("traceparent", s.TraceParent())
+	}
+}
+
+// Parallel works like Parallel but runs every task inside its own child span
+func (s *Span) Parallel(name string, tasks ...func() H) []H {
+	wrapped := make([]func() H, len(tasks))
+	for i, task := range tasks {
+		i, task := i, task
+		wrapped[i] = func() H {
+			child := s.Child(name, SpanKindInternal).SetAttr("parallel.index", i)
+			defer child.Finish()
+			return task()
+		}
+	}
+	return Parallel(wrapped...)
+}
+
+// SpanExporter sends finished spans
+type SpanExporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer creates spans and exports sampled ones in batches
+type Tracer struct {
+	ServiceName string
+	SampleRate  float64 // share of new traces to sample from 0 to 1, parent decision is used for continued traces
+	exporter    SpanExporter
+	queue       chan *Span
+	stop        chan bool
+	stopOnce    sync.Once
+	stopped     chan bool
+	dropped     int64
+}
+
+// TracerNew creates tracer and starts batch exporting
+func TracerNew(serviceName string, sampleRate float64, exporter SpanExporter) *Tracer {
+	t := &Tracer{
+		ServiceName: serviceName,
+		SampleRate:  sampleRate,
+		exporter:    exporter,
+		queue:       make(chan *Span, 4096),
+		stop:        make(chan bool),
+		stopped:     make(chan bool),
+	}
+	go t.loop()
+	return t
+}
+
+// Start starts root span or span continuing remote parent passed as traceparent value
+func (t *Tracer) Start(traceParent string, name string, kind int) *Span {
+	parent, err := ParseTraceParent(traceParent)
+	return t.start(parent, err == nil, name, kind)
+}
+
+func (t *Tracer) start(parent SpanContext, hasParent bool, name string, kind int) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: H{},
+		tracer:     t,
+	}
+	rand.Read(span.Context.SpanID[:])
+	if hasParent {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		// ratio sampling by trace id, so all nodes make the same decision
+		bound := uint64(t.SampleRate * float64(^uint64(0)))
+		span.Context.Sampled = t.SampleRate >= 1 || binary.BigEndian.Uint64(span.Context.TraceID[8:]) < bound
+	}
+	return span
+}
+
+// Dropped return number of spans dropped because export queue is full
+func (t *Tracer) Dropped() int64 {
+	return atomic.LoadInt64(&t.dropped)
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+func (t *Tracer) loop() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+	batch := []*Span{}
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.exporter.Export(batch)
+		if err != nil {
+			Err("[TRACE] export failed", err)
+		}
+		batch = []*Span{}
+	}
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= 512 {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					export()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown exports all finished spans and stops the tracer, it could be called several times
+func (t *Tracer) Shutdown() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.stopped
+}
+
+// Middleware starts server span for every request continuing traceparent of the client
+func (t *Tracer) Middleware(req *Request, next func()) {
+	route := req.Path
+	if req.Route != nil {
+		route = req.Route.Path
+	}
+	span := t.Start(req.GetHeader("traceparent"), req.Method()+" "+route, SpanKindServer)
+	span.SetAttr("http.method", req.Method())
+	span.SetAttr("http.route", route)
+	span.SetAttr("http.target", string(req.Ctx.RequestURI()))
+	span.SetAttr("net.peer.ip", req.GetRealIP().String())
+	req.Span = span
+	defer func() {
+		r := recover()
+		status := req.Ctx.Response.StatusCode()
+		if r != nil && J(r) != "skip" {
+			status = 500
+		}
+		span.SetAttr("http.status_code", status)
+		if status >= 500 {
+			span.SetStatus(SpanStatusError, "http status "+J(status))
+		}
+		if req.ReferenceID != 0 {
+			span.SetAttr("enduser.id", req.ReferenceID)
+		}
+		span.Finish()
+		if r != nil {
+			panic(r)
+		}
+	}()
+	next()
+}
+
+// StartSpan starts child span of the request span, return nil if request is not traced
+func (req *Request) StartSpan(name string) *Span {
+	return req.Span.Child(name, SpanKindInternal)
+}
+
+// otlpAttr is an attribute in OTLP/JSON format
+type otlpAttr struct {
+	Key   string `json:"key"`
+	Value H      `json:"value"`
+}
+
+func otlpAttrs(attrs H) []otlpAttr {
+	result := []otlpAttr{}
+	for _, k := range sortedHKeys(attrs) {
+		value := H{}
+		switch v := attrs[k].(type) {
+		case bool:
+			value["boolValue"] = v
+		case int:
+			value["intValue"] = strconv.Itoa(v)
+		case int64:
+			value["intValue"] = strconv.FormatInt(v, 10)
+		case float64:
+			value["doubleValue"] = v
+		default:
+			value["stringValue"] = J(v)
+		}
+		result = append(result, otlpAttr{Key: k, Value: value})
+	}
+	return result
+}
+
+func sortedHKeys(h H) []string {
+	s := S{}
+	for k := range h {
+		s[k] = ""
+	}
+	return sortedKeys(s)
+}
+
+// OTLPJSON encodes spans as OTLP/JSON ExportTraceServiceRequest
+func OTLPJSON(serviceName string, spans []*Span) ([]byte, error) {
+	items := []H{}
+	for _, span := range spans {
+		span.mux.Lock()
+		item := H{
+			"traceId":           hex.EncodeToString(span.Context.TraceID[:]),
+			"spanId":            hex.EncodeToString(span.Context.SpanID[:]),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        otlpAttrs(span.Attributes),
+			"status":            H{"code": span.Status, "message": span.StatusText},
+		}
+		if span.ParentID != [8]byte{} {
+			item["parentSpanId"] = hex.EncodeToString(span.ParentID[:])
+		}
+		span.mux.Unlock()
+		items = append(items, item)
+	}
+	return json.Marshal(H{
+		"resourceSpans": []H{{
+			"resource": H{"attributes": otlpAttrs(H{"service.name": serviceName})},
+			"scopeSpans": []H{{
+				"scope": H{"name": "zero"},
+				"spans": items,
+			}},
+		}},
+	})
+}
+
+// SpanFileExporter appends every batch as OTLP/JSON line to the file, useful for local testing without collector
+type SpanFileExporter struct {
+	ServiceName string
+	file        *os.File
+	mux         sync.Mutex
+}
+
+// SpanFileExporterNew opens file for appending
+func SpanFileExporterNew(path, serviceName string) (*SpanFileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &SpanFileExporter{ServiceName: serviceName, file: file}, nil
+}
+
+// Export implements SpanExporter
+func (e *SpanFileExporter) Export(spans []*Span) error {
+	data, err := OTLPJSON(e.ServiceName, spans)
+	if err != nil {
+		return err
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file
+func (e *SpanFileExporter) Close() error {
+	return e.file.Close()
+}
+
+// SpanOTLPExporter posts spans as OTLP/JSON to collector, url is like http://localhost:4318/v1/traces
+type SpanOTLPExporter struct {
+	ServiceName string
+	URL         string
+	Headers     S
+	client      fasthttp.Client
+}
+
+// SpanOTLPExporterNew creates collector exporter
+func SpanOTLPExporterNew(url, serviceName string) *SpanOTLPExporter {
+	return &SpanOTLPExporter{ServiceName: serviceName, URL: url}
+}
+
+// Export implements SpanExporter
+func (e *SpanOTLPExporter) Export(spans []*Span) error {
+	data, err := OTLPJSON(e.ServiceName, spans)
+	if err != nil {
+		return err
+	}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+	req.SetRequestURI(e.URL)
+	req.Header.SetMethod("POST")
+	req.Header.SetContentType("application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBody(data)
+	err = e.client.DoTimeout(req, resp, time.Second*10)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() >= 300 {
+		return errors.New("collector responded with status " + strconv.Itoa(resp.StatusCode()))
+	}
+	return nil
+}
@@ -2,71 +2,91 @@ package zero
 
 import (
 	"fmt"
-	"log"
-	"runtime/debug"
-	"time"
+	"strings"
+	"sync/atomic"
 
-	"github.com/fasthttp-contrib/websocket"
+	"github.com/fasthttp/websocket"
+	"github.com/valyala/fasthttp"
 )
 
-// UpgradeWS upgrades http request to websocket
+// UpgradeWS upgrades http request to websocket using HTTP.Sockets options. Socket is returned at once
+// so OnMessage, OnClose and timeouts could be set before the handler returns, connection starts after that.
+// cb is called when connection is established, before the first message is read, it could be nil.
+// req.Ctx is reused by fasthttp at that moment and must not be used inside cb
 func (req *Request) UpgradeWS(cb func(req *Request)) *Socket {
-	soc := Socket{
-		Write: make(chan []byte),
-		Read:  make(chan []byte),
-		Die:   make(chan bool),
-	}
-	upgrader := websocket.New(func(c *websocket.Conn) {
-		defer func() {
-			if r := recover(); r != nil {
-				fmt.Println("UNCATCHED PANIC", r)
-				debug.PrintStack()
-			}
-		}()
-
-		go func() {
-			for {
-				select {
-				case message := <-soc.Write:
-					if c == nil {
-						return
-					}
+	return req.UpgradeWSOptions(&req.http.Sockets, cb)
+}
 
-					c.SetWriteDeadline(time.Now().Add(30 * time.Second))
-					err := c.WriteMessage(websocket.TextMessage, message)
-					if err != nil {
-						log.Println("write:", err)
-						break
-					}
-				case <-soc.Die:
-					return
-				}
+// UpgradeWSOptions works like UpgradeWS with custom options
+func (req *Request) UpgradeWSOptions(opts *SocketOptions, cb func(req *Request)) *Socket {
+	soc := SocketNew()
+	req.Socket = soc
+	soc.Protocol = socketProtocol(req.GetHeader("Sec-WebSocket-Protocol"), opts.Protocols)
+	if codec, ok := SocketCodecs[soc.Protocol]; ok {
+		soc.Codec = codec
+	}
+	soc.compressMin = opts.CompressionMinSize
+	if soc.compressMin == 0 {
+		soc.compressMin = 512
+	}
+	upgrader := websocket.FastHTTPUpgrader{
+		EnableCompression: opts.Compression,
+		CheckOrigin: func(ctx *fasthttp.RequestCtx) bool {
+			return opts.CheckOrigin == nil || opts.CheckOrigin(req)
+		},
+	}
+	if soc.Protocol != "" {
+		upgrader.Subprotocols = []string{soc.Protocol}
+	}
 
+	err := upgrader.Upgrade(req.Ctx, func(c *websocket.Conn) { // handler is executed after request handler returns
+		atomic.AddInt64(&req.http.activeWS, 1)
+		defer atomic.AddInt64(&req.http.activeWS, -1)
+		if internalMetrics != nil {
+			internalMetrics.wsConnections.Inc()
+			defer internalMetrics.wsConnections.Dec()
+		}
+		if opts.MaxMessageSize > 0 {
+			c.SetReadLimit(opts.MaxMessageSize)
+		} else if opts.MaxMessageSize == 0 {
+			c.SetReadLimit(SocketMaxMessageSize)
+		}
+		if opts.Compression {
+			level := opts.CompressionLevel
+			if level == 0 {
+				level = 1
 			}
-
-		}()
-
-		go func() {
-			for {
-				_, message, err := c.ReadMessage()
-
-				if err != nil {
-					if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway) {
-						soc.Kill()
-						return
-					}
-				}
-				select {
-				case soc.Read <- message:
-				default:
-				}
+			c.SetCompressionLevel(level)
+		}
+		soc.run(c, func() {
+			if cb != nil {
+				cb(req)
 			}
-		}()
+		})
 	})
-
-	err := upgrader.Upgrade(req.Ctx) // returns only error, executes the handler you defined on the websocket.New before (the 'chat' function)
 	if err != nil {
 		fmt.Println("WS upgrade error", err)
+		soc.finish(SocketCloseAbnormal, err.Error(), false)
+	}
+	return soc
+}
+
+// socketProtocol picks the first of server protocols requested by client, protocols are json and msgpack by default
+func socketProtocol(header string, protocols []string) string {
+	if header == "" {
+		return ""
+	}
+	if len(protocols) == 0 {
+		protocols = []string{"json", "msgpack"}
+	}
+	requested := map[string]bool{}
+	for _, p := range strings.Split(header, ",") {
+		requested[strings.TrimSpace(p)] = true
+	}
+	for _, p := range protocols {
+		if requested[p] {
+			return p
+		}
 	}
-	return &soc
+	return ""
 }